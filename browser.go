@@ -2,14 +2,17 @@ package bus_tracker
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	lox "github.com/ariyn/lox_interpreter"
 	"github.com/joho/godotenv"
 	"github.com/playwright-community/playwright-go"
 	"io"
+	"io/fs"
 	"log"
 	"math"
 	"math/rand"
+	"net/http"
 	"os"
 	"strings"
 	"time"
@@ -18,8 +21,9 @@ import (
 var initScript = ""
 
 func init() {
+	// The environment may come from elsewhere than .env, e.g. in tests.
 	err := godotenv.Load()
-	if err != nil {
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		log.Fatal("Error loading .env file", err)
 	}
 
@@ -44,7 +48,10 @@ func init() {
 
 var _ lox.Callable = (*BrowserGetFunction)(nil)
 
+// BrowserGetFunction is browser(url), or browserWith(url, options) when
+// withOptions is set. See browserOptions for the options.
 type BrowserGetFunction struct {
+	withOptions bool
 }
 
 func (f BrowserGetFunction) Bind(instance *lox.LoxInstance) lox.Callable {
@@ -66,50 +73,92 @@ func (f BrowserGetFunction) Call(i *lox.Interpreter, arguments []interface{}) (v
 		return nil, fmt.Errorf("playwright() 1st argument need string, but got %v", arguments[0])
 	}
 
-	pw, err := playwright.Run(&playwright.RunOptions{
-		SkipInstallBrowsers: false,
-		Stdout:              os.Stdout,
-		Stderr:              os.Stderr,
-	})
+	var options browserOptions
+	if f.withOptions {
+		options, err = parseBrowserOptions(arguments)
+		if err != nil {
+			return
+		}
+	}
+
+	ctx := scriptContext(i)
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if Browsers == nil {
+		return nil, fmt.Errorf("browser pool is not started")
+	}
+
+	headers := map[string]string{
+		"Accept":                    "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7",
+		"Accept-Encoding":           "gzip, deflate, br, zstd",
+		"Accept-Language":           "ko-KR,ko;q=0.9",
+		"Cache-Control":             "no-cache",
+		"Pragma":                    "no-cache",
+		"Sec-Ch-Ua":                 `"Google Chrome";v="123", "Not:A-Brand";v="8", "Chromium";v="123"`,
+		"Sec-Fetch-Dest":            "document",
+		"Sec-Fetch-Mode":            "navigate",
+		"Sec-Fetch-Site":            "none",
+		"Sec-Fetch-User":            "?1",
+		"Upgrade-Insecure-Requests": "1",
+	}
+	// The defaults are in canonical form, so a script's accept-language
+	// replaces Accept-Language instead of being sent next to it.
+	for k, v := range options.headers {
+		headers[http.CanonicalHeaderKey(k)] = v
+	}
+
+	state := pageState{states: scriptOptions(i).States, key: defaultStateKey}
+	if options.state != "" {
+		state.key = options.state
+	}
+
+	storageState, err := state.load(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("could not start playwright: %v", err)
+		return
 	}
 
-	_browser, err := pw.Firefox.Launch(playwright.BrowserTypeLaunchOptions{
-		Args: []string{"--incognito"},
-	})
+	browsers, err := i.Globals.Get(lox.Token{Lexeme: browsersKey})
 	if err != nil {
-		return nil, fmt.Errorf("could not launch browser: %v", err)
-	}
-
-	_page, err := _browser.NewPage(playwright.BrowserNewPageOptions{
-		UserAgent: playwright.String(userAgent.(string)),
-		Locale:    playwright.String("ko-KR"),
-		ExtraHttpHeaders: map[string]string{
-			"Accept":                    "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7",
-			"Accept-Encoding":           "gzip, deflate, br, zstd",
-			"Accept-Language":           "ko-KR,ko;q=0.9",
-			"Cache-Control":             "no-cache",
-			"Cookie":                    "",
-			"Pragma":                    "no-cache",
-			"Sec-Ch-Ua":                 `"Google Chrome";v="123", "Not:A-Brand";v="8", "Chromium";v="123"`,
-			"Sec-Fetch-Dest":            "document",
-			"Sec-Fetch-Mode":            "navigate",
-			"Sec-Fetch-Site":            "none",
-			"Sec-Fetch-User":            "?1",
-			"Upgrade-Insecure-Requests": "1",
-		},
+		return nil, err
+	}
+
+	lease, err := browsers.(*openBrowsers).acquire(ctx, Browsers, playwright.BrowserNewContextOptions{
+		UserAgent:        playwright.String(userAgent.(string)),
+		Locale:           playwright.String("ko-KR"),
+		ExtraHttpHeaders: headers,
+		StorageState:     storageState,
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	_page, err := lease.Context.NewPage()
 	if err != nil {
 		return nil, fmt.Errorf("could not create page: %v", err)
 	}
 
+	if timeout := playwrightTimeout(ctx); timeout != nil {
+		_page.SetDefaultTimeout(*timeout)
+	}
+
 	_ = _page.SetViewportSize(1920, 1080)
+	err = options.route(_page)
+	if err != nil {
+		return nil, fmt.Errorf("could not route requests: %v", err)
+	}
+
 	err = _page.AddInitScript(playwright.Script{Content: playwright.String(initScript)})
 	if err != nil {
 		return
 	}
 
+	instance, err := newPageInstance(_page, state)
+	if err != nil {
+		return
+	}
+
 	//waitCtx, cancel := context.WithCancel(context.Background())
 	//defer cancel()
 
@@ -127,28 +176,61 @@ func (f BrowserGetFunction) Call(i *lox.Interpreter, arguments []interface{}) (v
 
 	//cancel()
 
-	browsers, err := i.Globals.Get(lox.Token{Lexeme: "_browsers"})
-	if err != nil {
-		browsers = make([]playwright.Browser, 0)
-		browsers = append(browsers.([]playwright.Browser), _browser)
-
-		i.Globals.Define("_browsers", browsers)
-	} else {
-		browsers = append(browsers.([]playwright.Browser), _browser)
-		i.Globals.Assign(lox.Token{Lexeme: "_browsers"}, browsers)
-	}
-
-	return NewPageInstance(_page)
+	return instance, nil
 }
 
 func (f BrowserGetFunction) Arity() int {
+	if f.withOptions {
+		return 2
+	}
+
 	return 1
 }
 
 func (f BrowserGetFunction) ToString() string {
+	if f.withOptions {
+		return "<native fn BrowserWith>"
+	}
+
 	return "<native fn Browser>"
 }
 
+// playwrightTimeout converts the time left until ctx's deadline into
+// milliseconds, as playwright's timeout options expect. It returns nil when
+// ctx has no deadline.
+func playwrightTimeout(ctx context.Context) *float64 {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return nil
+	}
+
+	remaining := time.Until(deadline)
+	if remaining < time.Millisecond {
+		remaining = time.Millisecond
+	}
+
+	return playwright.Float(float64(remaining.Milliseconds()))
+}
+
+// untilDone runs a page call that has no timeout option of its own. When ctx
+// is done first, the page is closed so the call returns, and ctx's error is
+// returned.
+func untilDone(ctx context.Context, page playwright.Page, call func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		_ = page.Close()
+		<-done
+		return ctx.Err()
+	}
+}
+
 func moveMouseRandom(ctx context.Context, page playwright.Page) (move func()) {
 	mouse := page.Mouse()
 	currentX, currentY := 130.0, 250.0
@@ -0,0 +1,245 @@
+package bus_tracker
+
+import (
+	"encoding/json"
+	"fmt"
+	lox "github.com/ariyn/lox_interpreter"
+	"github.com/playwright-community/playwright-go"
+	"sort"
+)
+
+var resourceTypes = map[string]bool{
+	"document":    true,
+	"stylesheet":  true,
+	"image":       true,
+	"media":       true,
+	"font":        true,
+	"script":      true,
+	"texttrack":   true,
+	"xhr":         true,
+	"fetch":       true,
+	"eventsource": true,
+	"websocket":   true,
+	"manifest":    true,
+	"other":       true,
+}
+
+type routeMock struct {
+	match   func(url string) bool
+	options playwright.RouteFulfillOptions
+}
+
+// browserOptions are the options browserWith() takes on top of the url:
+//   - block: resource types never to load, e.g. ["image", "font", "media"]
+//   - blockUrls: URL patterns never to load, e.g. ["*google-analytics*"]
+//   - headers: request headers to add or override
+//   - mocks: URL pattern to the response served instead, either a body or
+//     {status, contentType, headers, body}. Dictionary and list bodies are
+//     sent as JSON.
+//   - state: the key of the saved browser state to start from and save to,
+//     "default" when not given
+type browserOptions struct {
+	state      string
+	blockTypes map[string]bool
+	blockUrls  []func(url string) bool
+	headers    map[string]string
+	mocks      []routeMock
+}
+
+func parseBrowserOptions(arguments []any) (options browserOptions, err error) {
+	const name = "browserWith"
+	dict, err := optionsArgument(name, 1, arguments, "block", "blockUrls", "headers", "mocks", "state")
+	if err != nil {
+		return
+	}
+
+	state, err := stringOption(name, dict, "state")
+	if err != nil {
+		return
+	}
+	if state != nil {
+		if *state == "" {
+			return options, fmt.Errorf("%s() state needs a name", name)
+		}
+		options.state = *state
+	}
+
+	types, err := stringListOption(name, dict, "block")
+	if err != nil {
+		return
+	}
+
+	options.blockTypes = make(map[string]bool)
+	for _, t := range types {
+		if !resourceTypes[t] {
+			return options, fmt.Errorf("%s() cannot block unknown resource type %s", name, t)
+		}
+		options.blockTypes[t] = true
+	}
+
+	patterns, err := stringListOption(name, dict, "blockUrls")
+	if err != nil {
+		return
+	}
+
+	for _, pattern := range patterns {
+		match, err := urlMatcher(pattern)
+		if err != nil {
+			return options, fmt.Errorf("%s() %v", name, err)
+		}
+		options.blockUrls = append(options.blockUrls, match)
+	}
+
+	headers, err := dictOption(name, dict, "headers")
+	if err != nil {
+		return
+	}
+
+	options.headers = make(map[string]string)
+	for k, v := range headers {
+		value, ok := v.(string)
+		if !ok {
+			return options, fmt.Errorf("%s() header %s need string, but got %v", name, k, v)
+		}
+		options.headers[k] = value
+	}
+
+	mocks, err := dictOption(name, dict, "mocks")
+	if err != nil {
+		return
+	}
+
+	// Patterns are tried in order, so a page loads the same way every run.
+	mockPatterns := make([]string, 0, len(mocks))
+	for pattern := range mocks {
+		mockPatterns = append(mockPatterns, pattern)
+	}
+	sort.Strings(mockPatterns)
+
+	for _, pattern := range mockPatterns {
+		mock, err := parseMock(name, pattern, mocks[pattern])
+		if err != nil {
+			return options, err
+		}
+		options.mocks = append(options.mocks, mock)
+	}
+
+	return options, nil
+}
+
+func parseMock(name string, pattern string, value interface{}) (mock routeMock, err error) {
+	mock.match, err = urlMatcher(pattern)
+	if err != nil {
+		return mock, fmt.Errorf("%s() %v", name, err)
+	}
+
+	response, ok := value.(lox.DictType)
+	if !ok {
+		response = lox.DictType{"body": value}
+	}
+
+	for key := range response {
+		if key != "status" && key != "contentType" && key != "headers" && key != "body" {
+			return mock, fmt.Errorf("%s() mock %s got unknown option %s", name, pattern, key)
+		}
+	}
+
+	status, err := numberOption(name, response, "status")
+	if err != nil {
+		return
+	}
+	if status != nil {
+		mock.options.Status = playwright.Int(int(*status))
+	}
+
+	mock.options.ContentType, err = stringOption(name, response, "contentType")
+	if err != nil {
+		return
+	}
+
+	headers, err := dictOption(name, response, "headers")
+	if err != nil {
+		return
+	}
+	if headers != nil {
+		mock.options.Headers = make(map[string]string)
+		for k, v := range headers {
+			mock.options.Headers[k] = fmt.Sprint(v)
+		}
+	}
+
+	switch body := response["body"].(type) {
+	case nil:
+		mock.options.Body = ""
+	case string:
+		mock.options.Body = body
+	default:
+		b, err := json.Marshal(body)
+		if err != nil {
+			return mock, fmt.Errorf("%s() mock %s body: %v", name, pattern, err)
+		}
+
+		mock.options.Body = b
+		if mock.options.ContentType == nil {
+			mock.options.ContentType = playwright.String("application/json")
+		}
+	}
+
+	return mock, nil
+}
+
+func stringListOption(name string, options lox.DictType, key string) (values []string, err error) {
+	value, ok := options[key]
+	if !ok || value == nil {
+		return nil, nil
+	}
+
+	list, ok := value.(lox.ListType)
+	if !ok {
+		return nil, fmt.Errorf("%s() option %s need list, but got %v", name, key, value)
+	}
+
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s() option %s need strings, but got %v", name, key, item)
+		}
+		values = append(values, s)
+	}
+
+	return values, nil
+}
+
+// route intercepts the page's requests to mock and block them. Mocks win
+// over blocking, so a blocked tracker can still be answered with a stub.
+func (options browserOptions) route(page playwright.Page) error {
+	if len(options.blockTypes) == 0 && len(options.blockUrls) == 0 && len(options.mocks) == 0 {
+		return nil
+	}
+
+	return page.Route("**/*", func(route playwright.Route) {
+		request := route.Request()
+		url := request.URL()
+
+		for _, mock := range options.mocks {
+			if mock.match(url) {
+				_ = route.Fulfill(mock.options)
+				return
+			}
+		}
+
+		if options.blockTypes[request.ResourceType()] {
+			_ = route.Abort("blockedbyclient")
+			return
+		}
+
+		for _, match := range options.blockUrls {
+			if match(url) {
+				_ = route.Abort("blockedbyclient")
+				return
+			}
+		}
+
+		_ = route.Continue()
+	})
+}
@@ -0,0 +1,197 @@
+package bus_tracker
+
+import (
+	"context"
+	"fmt"
+	lox "github.com/ariyn/lox_interpreter"
+	"github.com/playwright-community/playwright-go"
+)
+
+// screenshotType reads the type and quality options shared by page and
+// locator screenshots. quality only applies to jpeg.
+func screenshotType(name string, options lox.DictType) (screenshotType *playwright.ScreenshotType, quality *int, err error) {
+	format, err := stringOption(name, options, "type")
+	if err != nil {
+		return
+	}
+
+	screenshotType = playwright.ScreenshotTypePng
+	if format != nil {
+		switch *format {
+		case "png":
+		case "jpeg", "jpg":
+			screenshotType = playwright.ScreenshotTypeJpeg
+		default:
+			return nil, nil, fmt.Errorf("%s() type must be png or jpeg, but got %s", name, *format)
+		}
+	}
+
+	q, err := numberOption(name, options, "quality")
+	if err != nil || q == nil {
+		return
+	}
+
+	if screenshotType != playwright.ScreenshotTypeJpeg {
+		return nil, nil, fmt.Errorf("%s() quality only applies to jpeg", name)
+	}
+
+	if *q < 0 || *q > 100 {
+		return nil, nil, fmt.Errorf("%s() quality must be between 0 and 100, but got %v", name, *q)
+	}
+
+	quality = playwright.Int(int(*q))
+	return
+}
+
+// screenshotImage wraps a screenshot taken with screenshotType into an Image.
+func screenshotImage(body []byte, screenshotType *playwright.ScreenshotType) *lox.LoxInstance {
+	if screenshotType == playwright.ScreenshotTypeJpeg {
+		return NewImageInstance(&Image{
+			Body:        body,
+			Name:        "screenshot.jpg",
+			ContentType: "image/jpeg",
+		})
+	}
+
+	return NewImageInstance(&Image{
+		Body:        body,
+		Name:        "screenshot.png",
+		ContentType: "image/png",
+	})
+}
+
+// screenshot takes a full page PNG screenshot, which is screenshotWith({}).
+func screenshot(ctx context.Context, page playwright.Page, _ []any) (v interface{}, err error) {
+	return screenshotWith(ctx, page, []any{lox.DictType{}})
+}
+
+// screenshotWith takes a page screenshot with the options
+//   - clip: {x, y, width, height}, the region to capture
+//   - fullPage: the whole scrollable page instead of the viewport, true by default
+//   - type: png or jpeg
+//   - quality: 0 to 100, jpeg only
+//
+// It is not page.screenshot({...}) because Lox calls must pass exactly as many
+// arguments as a function's arity, so screenshot() can't take an optional
+// options dictionary. Like browserWith and sessionWith, the variant that takes
+// options is a separate function.
+func screenshotWith(ctx context.Context, page playwright.Page, arguments []any) (v interface{}, err error) {
+	const name = "screenshotWith"
+	options, err := optionsArgument(name, 0, arguments, "clip", "fullPage", "type", "quality")
+	if err != nil {
+		return
+	}
+
+	screenshotOptions := playwright.PageScreenshotOptions{
+		FullPage: playwright.Bool(true),
+		Timeout:  playwrightTimeout(ctx),
+	}
+
+	screenshotOptions.Type, screenshotOptions.Quality, err = screenshotType(name, options)
+	if err != nil {
+		return
+	}
+
+	fullPage, err := boolOption(name, options, "fullPage")
+	if err != nil {
+		return
+	}
+	if fullPage != nil {
+		screenshotOptions.FullPage = fullPage
+	}
+
+	clip, err := dictOption(name, options, "clip")
+	if err != nil {
+		return
+	}
+	if clip != nil {
+		screenshotOptions.Clip, err = clipOption(name, clip)
+		if err != nil {
+			return
+		}
+	}
+
+	body, err := page.Screenshot(screenshotOptions)
+	if err != nil {
+		return nil, fmt.Errorf("could not take screenshot: %v", err)
+	}
+
+	return screenshotImage(body, screenshotOptions.Type), nil
+}
+
+func clipOption(name string, clip lox.DictType) (rect *playwright.Rect, err error) {
+	values := make([]float64, 4)
+	for i, key := range []string{"x", "y", "width", "height"} {
+		n, err := numberOption(name, clip, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if n == nil {
+			return nil, fmt.Errorf("%s() clip needs x, y, width and height, but %s is missing", name, key)
+		}
+
+		values[i] = *n
+	}
+
+	if values[2] <= 0 || values[3] <= 0 {
+		return nil, fmt.Errorf("%s() clip needs a positive size, but got %vx%v", name, values[2], values[3])
+	}
+
+	return &playwright.Rect{X: values[0], Y: values[1], Width: values[2], Height: values[3]}, nil
+}
+
+// locatorScreenshot captures just the element, scrolling it into view first.
+func locatorScreenshot(ctx context.Context, locator playwright.Locator, _ playwright.Page, _ []any) (v interface{}, err error) {
+	body, err := locator.Screenshot(playwright.LocatorScreenshotOptions{
+		Timeout: playwrightTimeout(ctx),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not take screenshot: %v", err)
+	}
+
+	return screenshotImage(body, playwright.ScreenshotTypePng), nil
+}
+
+// pdf prints the page as an A4 PDF with backgrounds. Playwright can only
+// print from chromium, so the browser pool must run with BROWSER_TYPE=chromium.
+func pdf(ctx context.Context, page playwright.Page, _ []any) (v interface{}, err error) {
+	browserType := page.Context().Browser().BrowserType().Name()
+	if browserType != "chromium" {
+		return nil, fmt.Errorf("pdf() needs chromium, but the browser is %s", browserType)
+	}
+
+	// Printing has no timeout option, so the page is closed when ctx is done.
+	var body []byte
+	err = untilDone(ctx, page, func() (err error) {
+		body, err = page.PDF(playwright.PagePdfOptions{
+			Format:          playwright.String("A4"),
+			PrintBackground: playwright.Bool(true),
+		})
+		return
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not print pdf: %v", err)
+	}
+
+	return NewFileInstance(&Image{
+		Url:         page.URL(),
+		Body:        body,
+		Name:        "page.pdf",
+		ContentType: "application/pdf",
+	}), nil
+}
+
+// NewFileInstance wraps a binary artifact that is not an image, such as a
+// PDF. It is saved and replaced in results just like an Image, but has none
+// of the image methods.
+func NewFileInstance(file *Image) *lox.LoxInstance {
+	instance := lox.NewLoxInstance(
+		lox.NewLoxClass("File", nil, map[string]lox.Callable{
+			"save": newImageFunction("save", 0, save),
+		}))
+
+	_ = instance.Set(lox.Token{Lexeme: "_image"}, lox.NewLiteralExpr(file))
+
+	return instance
+}
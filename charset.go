@@ -0,0 +1,81 @@
+package bus_tracker
+
+import (
+	"fmt"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/korean"
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+// fallbackEncoding is assumed for text that declares no charset and is not
+// valid UTF-8. Legacy Korean sites are the ones that still do this. It also
+// decodes the CP949 extensions of EUC-KR.
+var fallbackEncoding encoding.Encoding = korean.EUCKR
+
+// charsetAliases are names Korean sites use that the WHATWG encoding list
+// lacks. They all mean the CP949 superset of EUC-KR.
+var charsetAliases = map[string]string{
+	"cp949":       "euc-kr",
+	"ms949":       "euc-kr",
+	"uhc":         "euc-kr",
+	"windows-949": "euc-kr",
+}
+
+// isText tells whether a content type is text that is transcoded to UTF-8
+// before it is parsed.
+func isText(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "json") ||
+		strings.HasSuffix(mediaType, "xml") ||
+		mediaType == "application/javascript"
+}
+
+// decodeText transcodes a text body to UTF-8. The charset is, in order, the
+// override when it is not empty, a byte order mark, the charset in
+// contentType, and for HTML a <meta charset>. Without any, UTF-8 is kept
+// and anything else is read as EUC-KR.
+func decodeText(body []byte, contentType string, override string) ([]byte, error) {
+	var e encoding.Encoding
+	if override != "" {
+		label := strings.ToLower(strings.TrimSpace(override))
+		if alias, ok := charsetAliases[label]; ok {
+			label = alias
+		}
+
+		e, _ = charset.Lookup(label)
+		if e == nil {
+			return nil, fmt.Errorf("unknown charset %s", override)
+		}
+	} else {
+		determined, name, certain := charset.DetermineEncoding(body, contentType)
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+
+		// Uncertain results come from <meta>, which only HTML has, or are
+		// guesses; windows-1252 is what is guessed when nothing matches.
+		switch {
+		case certain:
+			e = determined
+		case mediaType == "text/html" && name != "windows-1252":
+			e = determined
+		case utf8.Valid(body):
+			return body, nil
+		default:
+			e = fallbackEncoding
+		}
+	}
+
+	if e == encoding.Nop {
+		return body, nil
+	}
+
+	decoded, err := e.NewDecoder().Bytes(body)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode body: %v", err)
+	}
+
+	return decoded, nil
+}
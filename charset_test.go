@@ -0,0 +1,47 @@
+package bus_tracker
+
+import (
+	"golang.org/x/text/encoding/korean"
+	"testing"
+)
+
+func TestDecodeText(t *testing.T) {
+	// 똠 is one of the CP949 extensions to EUC-KR.
+	const text = "버스 도착 정보 똠"
+	eucKR, err := korean.EUCKR.NewEncoder().String(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := `<html><head><meta charset="euc-kr"></head><body>` + eucKR + `</body></html>`
+
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		override    string
+		want        string
+		wantErr     bool
+	}{
+		{"utf-8 without charset", text, "text/plain", "", text, false},
+		{"euc-kr without charset", eucKR, "text/plain", "", text, false},
+		{"euc-kr json without charset", eucKR, "application/json", "", text, false},
+		{"declared euc-kr", eucKR, "text/plain; charset=euc-kr", "", text, false},
+		{"declared cp949 override", eucKR, "text/plain; charset=utf-8", "CP949", text, false},
+		{"ms949 override", eucKR, "text/plain", "ms949", text, false},
+		{"html meta charset", html, "text/html", "", `<html><head><meta charset="euc-kr"></head><body>` + text + `</body></html>`, false},
+		{"utf-8 override", text, "text/plain; charset=euc-kr", "utf-8", text, false},
+		{"unknown override", text, "text/plain", "klingon", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeText([]byte(tt.body), tt.contentType, tt.override)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeText() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("decodeText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package bus_tracker
+
+import (
+	lox "github.com/ariyn/lox_interpreter"
+)
+
+const checkpointKey = "_checkpoint"
+
+// withCheckpoints rewrites a script's tokens so it calls _checkpoint on every
+// loop iteration and at the start of every function, method, if and loop
+// block. The interpreter has no way to be stopped from outside, so this is
+// what stops a script like `while (true) {}` once its context is done.
+//
+// `while (cond)` becomes `while (_checkpoint() and (cond))`, the condition of
+// `for (init; cond; incr)` is rewritten the same way, and `{` right after `)`
+// is followed by `_checkpoint();`.
+func withCheckpoints(tokens []lox.Token) []lox.Token {
+	rewritten := make([]lox.Token, 0, len(tokens))
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		rewritten = append(rewritten, token)
+
+		switch {
+		case token.Type == lox.WHILE && i+1 < len(tokens) && tokens[i+1].Type == lox.LEFT_PAREN:
+			end := closingParen(tokens, i+1)
+			if end < 0 {
+				continue
+			}
+
+			rewritten = append(rewritten, tokens[i+1])
+			rewritten = appendCondition(rewritten, tokens[i+2:end], tokens[i+1].LineNumber)
+			i = end - 1
+		case token.Type == lox.FOR && i+1 < len(tokens) && tokens[i+1].Type == lox.LEFT_PAREN:
+			end := closingParen(tokens, i+1)
+			if end < 0 {
+				continue
+			}
+
+			first := semicolon(tokens, i+2, end)
+			if first < 0 {
+				continue
+			}
+			second := semicolon(tokens, first+1, end)
+			if second < 0 {
+				continue
+			}
+
+			rewritten = append(rewritten, tokens[i+1:first+1]...)
+			rewritten = appendCondition(rewritten, tokens[first+1:second], tokens[first].LineNumber)
+			i = second - 1
+		case token.Type == lox.LEFT_BRACE && i > 0 && tokens[i-1].Type == lox.RIGHT_PAREN:
+			rewritten = append(rewritten, checkpointCall(token.LineNumber)...)
+			rewritten = append(rewritten, lox.Token{Type: lox.SEMICOLON, Lexeme: ";", LineNumber: token.LineNumber})
+		}
+	}
+
+	return rewritten
+}
+
+// appendCondition appends `_checkpoint() and (condition)`, or only
+// `_checkpoint()` when the condition is empty.
+func appendCondition(tokens []lox.Token, condition []lox.Token, line int) []lox.Token {
+	tokens = append(tokens, checkpointCall(line)...)
+	if len(condition) == 0 {
+		return tokens
+	}
+
+	tokens = append(tokens,
+		lox.Token{Type: lox.AND, Lexeme: "and", LineNumber: line},
+		lox.Token{Type: lox.LEFT_PAREN, Lexeme: "(", LineNumber: line},
+	)
+	tokens = append(tokens, condition...)
+	return append(tokens, lox.Token{Type: lox.RIGHT_PAREN, Lexeme: ")", LineNumber: line})
+}
+
+func checkpointCall(line int) []lox.Token {
+	return []lox.Token{
+		{Type: lox.IDENTIFIER, Lexeme: checkpointKey, LineNumber: line},
+		{Type: lox.LEFT_PAREN, Lexeme: "(", LineNumber: line},
+		{Type: lox.RIGHT_PAREN, Lexeme: ")", LineNumber: line},
+	}
+}
+
+// closingParen returns the index of the parenthesis closing the one at open,
+// or -1 when it isn't closed.
+func closingParen(tokens []lox.Token, open int) int {
+	depth := 0
+	for i := open; i < len(tokens); i++ {
+		switch tokens[i].Type {
+		case lox.LEFT_PAREN:
+			depth++
+		case lox.RIGHT_PAREN:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// semicolon returns the index of the first semicolon in tokens[from:to] that
+// isn't nested in parentheses, or -1 when there is none.
+func semicolon(tokens []lox.Token, from, to int) int {
+	depth := 0
+	for i := from; i < to; i++ {
+		switch tokens[i].Type {
+		case lox.LEFT_PAREN:
+			depth++
+		case lox.RIGHT_PAREN:
+			depth--
+		case lox.SEMICOLON:
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+var _ lox.Callable = (*CheckpointFunction)(nil)
+
+// CheckpointFunction fails once the script's context is done. Scripts don't
+// call it themselves; withCheckpoints adds the calls.
+type CheckpointFunction struct {
+}
+
+func (n CheckpointFunction) Call(interpreter *lox.Interpreter, arguments []interface{}) (interface{}, error) {
+	err := scriptContext(interpreter).Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return true, nil
+}
+
+func (n CheckpointFunction) Arity() int {
+	return 0
+}
+
+func (n CheckpointFunction) ToString() string {
+	return "<native fn>"
+}
+
+func (n CheckpointFunction) Bind(instance *lox.LoxInstance) lox.Callable {
+	return n
+}
@@ -0,0 +1,82 @@
+package bus_tracker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunStopsScripts(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"while", "while (true) {}"},
+		{"while without block", "var i = 0; while (true) i = i + 1;"},
+		{"for", "for (var i = 0; ; i = i + 1) {}"},
+		{"for with condition", "for (var i = 0; i >= 0; i = i + 1) {}"},
+		{"recursion", "fun f(n) { return f(n + 1); } return f(0);"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bt, err := NewBusTrackerScript(tt.script, nil, ScriptOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := bt.Run(ctx)
+				done <- err
+			}()
+
+			select {
+			case err = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("script is still running")
+			}
+
+			var timeout *TimeoutError
+			if !errors.As(err, &timeout) {
+				t.Errorf("Run() error = %v, want *TimeoutError", err)
+			}
+		})
+	}
+}
+
+func TestWithCheckpointsKeepsResults(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   interface{}
+	}{
+		{"while", "var i = 0; while (i < 10) i = i + 1; return i;", 10.0},
+		{"for", "var sum = 0; for (var i = 0; i < 5; i = i + 1) { sum = sum + i; } return sum;", 10.0},
+		{"for without initializer", "var i = 0; for (; i < 3; i = i + 1) {} return i;", 3.0},
+		{"nested condition", "var i = 0; while ((i < 3) and (true)) i = i + 1; return i;", 3.0},
+		{"function", "fun add(a, b) { return a + b; } return add(1, 2);", 3.0},
+		{"if", "if (false) { return 1; } else { return 2; }", 2.0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bt, err := NewBusTrackerScript(tt.script, nil, ScriptOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := bt.Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Run() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	bus_tracker "github.com/ariyn/bus-tracker"
+	"github.com/ariyn/bus-tracker/storage"
 	"github.com/boltdb/bolt"
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
@@ -13,12 +16,17 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 var expirationDays time.Duration = 90
+var scriptTimeout = 30 * time.Second
 var jwtSecret []byte
 var boltdb *bolt.DB
+var imageStorage storage.Storage
+var retryPolicy bus_tracker.RetryPolicy
 
 func init() {
 	err := godotenv.Load()
@@ -31,6 +39,28 @@ func init() {
 		log.Fatal("JWT_SECRET is not set")
 	}
 
+	if timeout := os.Getenv("SCRIPT_TIMEOUT"); timeout != "" {
+		scriptTimeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			log.Fatal("invalid SCRIPT_TIMEOUT", err)
+		}
+	}
+
+	imageStorage, err = storage.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	browserStateKey, err = bus_tracker.BrowserStateKeyFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	retryPolicy, err = bus_tracker.RetryPolicyFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	dbPath := os.Getenv("BOLTDB_PATH")
 	if len(dbPath) == 0 {
 		log.Fatal("BOLTDB_PATH is not set")
@@ -61,6 +91,11 @@ func initDB() {
 		log.Fatal(err)
 	}
 
+	_, err = tx.CreateBucketIfNotExists([]byte(browserStatesBucket))
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		log.Fatal(err)
@@ -95,9 +130,44 @@ func main() {
 
 	functions.GET("/:name", functionInvoke)
 	functions.POST("/:name", functionCreate)
+	functions.DELETE("/:name/states", stateClear)
+	functions.DELETE("/:name/states/:state", stateClear)
+
+	poolOptions, err := bus_tracker.BrowserPoolOptionsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bus_tracker.Browsers, err = bus_tracker.NewBrowserPool(poolOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	// Start server
-	e.Logger.Fatal(e.Start(":1323"))
+	go func() {
+		err := e.Start(":1323")
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), scriptTimeout)
+	defer cancel()
+
+	err = e.Shutdown(shutdownCtx)
+	if err != nil {
+		e.Logger.Error(err)
+	}
+
+	err = bus_tracker.Browsers.Close(shutdownCtx)
+	if err != nil {
+		e.Logger.Error(err)
+	}
 }
 
 func requestKey(c echo.Context) (err error) {
@@ -201,12 +271,33 @@ func functionInvoke(c echo.Context) (err error) {
 		return c.String(http.StatusBadRequest, fmt.Sprintf("failed to unmarshal function: %s", err))
 	}
 
-	bts, err := bus_tracker.NewBusTrackerScript(string(f.Code))
+	// The script may save browser states, which needs a write transaction that
+	// could wait on this one.
+	_ = tx.Rollback()
+
+	states, err := browserStates(name + key)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("failed to open browser states: %s", err))
+	}
+
+	bts, err := bus_tracker.NewBusTrackerScript(string(f.Code), nil, bus_tracker.ScriptOptions{
+		Storage: imageStorage,
+		States:  states,
+		Retry:   &retryPolicy,
+		Logger:  log.New(log.Writer(), fmt.Sprintf("function %s: ", name), log.Flags()|log.Lmsgprefix),
+	})
 	if err != nil {
 		return c.String(http.StatusInternalServerError, fmt.Sprintf("failed to instantiate scripting environment: %s", err))
 	}
 
-	v, err := bts.Run()
+	ctx, cancel := context.WithTimeout(c.Request().Context(), scriptTimeout)
+	defer cancel()
+
+	v, err := bts.Run(ctx)
+	var timeoutErr *bus_tracker.TimeoutError
+	if errors.As(err, &timeoutErr) {
+		return c.String(http.StatusGatewayTimeout, fmt.Sprintf("timed out: %s", err))
+	}
 	if err != nil {
 		return c.String(http.StatusInternalServerError, fmt.Sprintf("failed: %s", err))
 	}
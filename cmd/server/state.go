@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	bus_tracker "github.com/ariyn/bus-tracker"
+	"github.com/boltdb/bolt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+const browserStatesBucket = "browser_states"
+
+// browserStateKey encrypts browser states. States are not kept when it is
+// not set.
+var browserStateKey []byte
+
+var _ bus_tracker.BrowserStates = functionStates{}
+
+// functionStates keeps the browser states of one function in boltdb, under
+// the function's own key followed by a slash and the state key.
+type functionStates struct {
+	functionKey string
+}
+
+func (s functionStates) prefix() []byte {
+	return []byte(s.functionKey + "/")
+}
+
+func (s functionStates) LoadState(_ context.Context, key string) (state []byte, err error) {
+	err = boltdb.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(browserStatesBucket)).Get(append(s.prefix(), key...))
+		if v != nil {
+			state = append([]byte(nil), v...)
+		}
+		return nil
+	})
+
+	return state, err
+}
+
+func (s functionStates) SaveState(_ context.Context, key string, state []byte) error {
+	return boltdb.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(browserStatesBucket)).Put(append(s.prefix(), key...), state)
+	})
+}
+
+// clear deletes the state under key, or every state of the function when key
+// is empty, and returns how many it deleted.
+func (s functionStates) clear(key string) (n int, err error) {
+	err = boltdb.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(browserStatesBucket))
+		if key != "" {
+			k := append(s.prefix(), key...)
+			if bucket.Get(k) == nil {
+				return nil
+			}
+
+			n = 1
+			return bucket.Delete(k)
+		}
+
+		var keys [][]byte
+		c := bucket.Cursor()
+		for k, _ := c.Seek(s.prefix()); k != nil && bytes.HasPrefix(k, s.prefix()); k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+
+		for _, k := range keys {
+			err := bucket.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+
+		n = len(keys)
+		return nil
+	})
+
+	return n, err
+}
+
+// browserStates returns the encrypted states of the function, or nil when
+// states are not kept.
+func browserStates(functionKey string) (bus_tracker.BrowserStates, error) {
+	if browserStateKey == nil {
+		return nil, nil
+	}
+
+	return bus_tracker.NewEncryptedStates(functionStates{functionKey: functionKey}, functionKey, browserStateKey)
+}
+
+// stateClear forgets the browser state named by the state parameter, or
+// every browser state of the function when there is none, e.g. to force a
+// new login.
+func stateClear(c echo.Context) (err error) {
+	key := c.Get("key").(string)
+	name := c.Param("name")
+
+	n, err := functionStates{functionKey: name + key}.clear(c.Param("state"))
+	if err != nil {
+		return
+	}
+
+	return c.JSON(http.StatusOK, map[string]int{
+		"cleared": n,
+	})
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Missed-run policies, for when a crontab is picked up after one or more of
+// its schedule times have passed, e.g. after worker downtime.
+const (
+	// missedRunOnce runs a single task for all missed times.
+	missedRunOnce = "once"
+	// missedRunSkip drops missed times; only a fire picked up within
+	// missedRunGrace of its jittered run time runs.
+	missedRunSkip = "skip"
+	// missedRunAll runs one task per missed time, up to maxCatchUpRuns.
+	missedRunAll = "all"
+)
+
+const missedRunGrace = 1 * time.Minute
+const maxCatchUpRuns = 100
+const maxCronSleep = 1 * time.Minute
+
+// cronErrorBackoff postpones a crontab whose fire failed for another reason
+// than its schedule, e.g. a failed task insert, so it doesn't block the
+// crontabs due after it.
+const cronErrorBackoff = 1 * time.Minute
+
+var cronParser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// Cronjob is the JSON stored in crontabs.crontab. Expression accepts five
+// fields, six with leading seconds, or descriptors such as @hourly and
+// @every 30s. Without an Expression, one is built from the field lists, where
+// an empty list means every value.
+type Cronjob struct {
+	Expression string
+	Minutes    []int
+	Hours      []int
+	DayOfMonth []int
+	DaysOfWeek []int
+	Month      []int
+
+	// Timezone is an IANA zone name such as Asia/Seoul. Empty means the
+	// worker's local zone.
+	Timezone string
+	// MissedRuns is one of once, skip or all. Empty means once.
+	MissedRuns string
+	// JitterSeconds delays every fire by a random duration up to this many
+	// seconds.
+	JitterSeconds int
+}
+
+func (c Cronjob) expression() string {
+	if c.Expression != "" {
+		return c.Expression
+	}
+
+	fields := make([]string, 0, 5)
+	for _, values := range [][]int{c.Minutes, c.Hours, c.DayOfMonth, c.Month, c.DaysOfWeek} {
+		if len(values) == 0 {
+			fields = append(fields, "*")
+			continue
+		}
+
+		s := make([]string, len(values))
+		for i, v := range values {
+			s[i] = strconv.Itoa(v)
+		}
+		fields = append(fields, strings.Join(s, ","))
+	}
+
+	return strings.Join(fields, " ")
+}
+
+func (c Cronjob) schedule() (schedule cron.Schedule, location *time.Location, err error) {
+	location = time.Local
+	if c.Timezone != "" {
+		location, err = time.LoadLocation(c.Timezone)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid timezone %s: %v", c.Timezone, err)
+		}
+	}
+
+	schedule, err = cronParser.Parse(c.expression())
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid expression %s: %v", c.expression(), err)
+	}
+
+	return schedule, location, nil
+}
+
+// dueTimes returns the schedule times to run tasks for, given that the fire
+// at scheduledAt, due to run at runAt once jittered, is being picked up at
+// now.
+func (c Cronjob) dueTimes(schedule cron.Schedule, location *time.Location, scheduledAt time.Time, runAt time.Time, now time.Time) (due []time.Time, err error) {
+	switch c.MissedRuns {
+	case "", missedRunOnce:
+		return []time.Time{scheduledAt}, nil
+	case missedRunSkip:
+		// Lateness counts from runAt, or any jitter over missedRunGrace
+		// would skip fires that are on time.
+		if now.Sub(runAt) > missedRunGrace {
+			return nil, nil
+		}
+		return []time.Time{scheduledAt}, nil
+	case missedRunAll:
+		for t := scheduledAt.In(location); !t.After(now) && len(due) < maxCatchUpRuns; t = schedule.Next(t) {
+			due = append(due, t)
+		}
+		return due, nil
+	default:
+		return nil, fmt.Errorf("unknown missed run policy %s", c.MissedRuns)
+	}
+}
+
+// nextRun returns the next schedule time after now and the time it should
+// actually fire, with jitter applied.
+func (c Cronjob) nextRun(schedule cron.Schedule, location *time.Location, now time.Time) (scheduledAt time.Time, runAt time.Time) {
+	scheduledAt = schedule.Next(now.In(location))
+	runAt = scheduledAt
+	if c.JitterSeconds > 0 {
+		runAt = runAt.Add(time.Duration(rand.Int63n(int64(c.JitterSeconds) * int64(time.Second))))
+	}
+
+	return scheduledAt, runAt
+}
+
+// scheduleCronjobs fires due crontabs until ctx is done. It sleeps until the
+// earliest next_run_at, but never longer than maxCronSleep so new crontabs
+// are noticed.
+func scheduleCronjobs(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		err := getCronjob()
+		if err != nil {
+			log.Println(err)
+		}
+
+		timer.Reset(untilNextCronjob())
+	}
+}
+
+func untilNextCronjob() time.Duration {
+	var next sql.NullTime
+	err := db.QueryRow("SELECT MIN(next_run_at) FROM crontabs WHERE enabled").Scan(&next)
+	if err != nil {
+		log.Println(err)
+		return maxCronSleep
+	}
+
+	if !next.Valid {
+		return maxCronSleep
+	}
+
+	return max(min(time.Until(next.Time), maxCronSleep), 0)
+}
+
+// getCronjob fires every due crontab, one transaction each.
+func getCronjob() (err error) {
+	for {
+		fired, err := fireCronjob()
+		if err != nil || !fired {
+			return err
+		}
+	}
+}
+
+// fireCronjob locks the most overdue enabled crontab, queues its tasks and
+// moves it to its next run, all in one transaction. Other workers skip the
+// locked row, and a replayed fire can't queue a task twice because tasks are
+// unique per (cron_id, scheduled_at). A crontab that can't be scheduled is
+// disabled with the error recorded, and one that fails otherwise is
+// postponed by cronErrorBackoff. It reports whether a crontab was found.
+func fireCronjob() (fired bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	var id, functionId, crontabString string
+	var scheduledAt, runAt time.Time
+	err = tx.QueryRow(`SELECT id, function_id, crontab, COALESCE(scheduled_at, next_run_at), next_run_at FROM crontabs
+WHERE enabled AND next_run_at <= NOW()
+ORDER BY next_run_at
+LIMIT 1
+FOR UPDATE SKIP LOCKED`).Scan(&id, &functionId, &crontabString, &scheduledAt, &runAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			postponeCronjob(tx, id, err)
+		}
+	}()
+
+	now := time.Now()
+	var cronjob Cronjob
+	var schedule cron.Schedule
+	var location *time.Location
+	var due []time.Time
+	err = json.Unmarshal([]byte(crontabString), &cronjob)
+	if err == nil {
+		schedule, location, err = cronjob.schedule()
+	}
+	if err == nil {
+		due, err = cronjob.dueTimes(schedule, location, scheduledAt, runAt, now)
+	}
+	if err != nil {
+		log.Printf("disabling crontab %s: %v", id, err)
+		_, err = tx.Exec("UPDATE crontabs SET enabled = FALSE, last_error = $1 WHERE id = $2", err.Error(), id)
+		if err != nil {
+			return
+		}
+
+		return true, tx.Commit()
+	}
+
+	for _, t := range due {
+		_, err = tx.Exec(`INSERT INTO tasks (function_id, status, user_id, cron_id, scheduled_at)
+VALUES ($1, 'pending', (SELECT user_id FROM crontabs WHERE id = $2), $2, $3)
+ON CONFLICT (cron_id, scheduled_at) WHERE cron_id IS NOT NULL DO NOTHING`, functionId, id, t)
+		if err != nil {
+			return
+		}
+	}
+
+	if len(due) == 0 {
+		log.Printf("skipped missed run of crontab %s scheduled at %s", id, scheduledAt.Format(time.RFC3339))
+	}
+
+	next, nextRunAt := cronjob.nextRun(schedule, location, now)
+	_, err = tx.Exec("UPDATE crontabs SET scheduled_at = $1, next_run_at = $2, last_error = NULL WHERE id = $3", next, nextRunAt, id)
+	if err != nil {
+		return
+	}
+
+	return true, tx.Commit()
+}
+
+// postponeCronjob records why the crontab failed to fire and moves its
+// next_run_at back by cronErrorBackoff, keeping the schedule time it is due
+// for.
+func postponeCronjob(tx *sql.Tx, id string, cause error) {
+	// The failed transaction holds the crontab's row lock until it is gone.
+	_ = tx.Rollback()
+
+	log.Printf("crontab %s failed to fire, retrying in %s: %v", id, cronErrorBackoff, cause)
+	_, err := db.Exec("UPDATE crontabs SET last_error = $1, next_run_at = NOW() + $2 * INTERVAL '1 second' WHERE id = $3", cause.Error(), cronErrorBackoff.Seconds(), id)
+	if err != nil {
+		log.Println(err)
+	}
+}
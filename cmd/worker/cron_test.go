@@ -0,0 +1,199 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronjobExpression(t *testing.T) {
+	tests := []struct {
+		cronjob Cronjob
+		want    string
+	}{
+		{cronjob: Cronjob{Expression: "@every 30s", Minutes: []int{5}}, want: "@every 30s"},
+		{cronjob: Cronjob{}, want: "* * * * *"},
+		{cronjob: Cronjob{Minutes: []int{0, 30}, Hours: []int{9}, DaysOfWeek: []int{1, 5}}, want: "0,30 9 * * 1,5"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.cronjob.expression(); got != tt.want {
+			t.Errorf("expression() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestCronjobSchedule(t *testing.T) {
+	for _, c := range []Cronjob{
+		{Expression: "not a schedule"},
+		{Expression: "* * * * *", Timezone: "Mars/Olympus_Mons"},
+	} {
+		if _, _, err := c.schedule(); err == nil {
+			t.Errorf("schedule() of %+v succeeded, want an error", c)
+		}
+	}
+}
+
+func TestCronjobDueTimes(t *testing.T) {
+	scheduledAt := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		cronjob Cronjob
+		runAt   time.Time
+		now     time.Time
+		want    []time.Time
+	}{
+		{
+			name:    "once on time",
+			cronjob: Cronjob{Expression: "0 * * * *", Timezone: "UTC"},
+			runAt:   scheduledAt,
+			now:     scheduledAt,
+			want:    []time.Time{scheduledAt},
+		},
+		{
+			name:    "once after downtime",
+			cronjob: Cronjob{Expression: "0 * * * *", Timezone: "UTC"},
+			runAt:   scheduledAt,
+			now:     scheduledAt.Add(5 * time.Hour),
+			want:    []time.Time{scheduledAt},
+		},
+		{
+			name:    "skip within grace",
+			cronjob: Cronjob{Expression: "0 * * * *", Timezone: "UTC", MissedRuns: missedRunSkip},
+			runAt:   scheduledAt,
+			now:     scheduledAt.Add(missedRunGrace),
+			want:    []time.Time{scheduledAt},
+		},
+		{
+			name:    "skip after grace",
+			cronjob: Cronjob{Expression: "0 * * * *", Timezone: "UTC", MissedRuns: missedRunSkip},
+			runAt:   scheduledAt,
+			now:     scheduledAt.Add(missedRunGrace + time.Second),
+		},
+		{
+			name:    "skip on time with jitter over grace",
+			cronjob: Cronjob{Expression: "0 * * * *", Timezone: "UTC", MissedRuns: missedRunSkip, JitterSeconds: 600},
+			runAt:   scheduledAt.Add(9 * time.Minute),
+			now:     scheduledAt.Add(9 * time.Minute),
+			want:    []time.Time{scheduledAt},
+		},
+		{
+			name:    "all after downtime",
+			cronjob: Cronjob{Expression: "0 * * * *", Timezone: "UTC", MissedRuns: missedRunAll},
+			runAt:   scheduledAt,
+			now:     scheduledAt.Add(2*time.Hour + 30*time.Minute),
+			want:    []time.Time{scheduledAt, scheduledAt.Add(time.Hour), scheduledAt.Add(2 * time.Hour)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, location, err := tt.cronjob.schedule()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := tt.cronjob.dueTimes(schedule, location, scheduledAt, tt.runAt, tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("dueTimes() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if !got[i].Equal(tt.want[i]) {
+					t.Errorf("dueTimes()[%d] = %s, want %s", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCronjobDueTimesCatchUpLimit(t *testing.T) {
+	c := Cronjob{Expression: "@every 1s", MissedRuns: missedRunAll}
+	schedule, location, err := c.schedule()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scheduledAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	got, err := c.dueTimes(schedule, location, scheduledAt, scheduledAt, scheduledAt.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != maxCatchUpRuns {
+		t.Errorf("dueTimes() returned %d times, want %d", len(got), maxCatchUpRuns)
+	}
+}
+
+func TestCronjobDueTimesUnknownPolicy(t *testing.T) {
+	c := Cronjob{Expression: "0 * * * *", MissedRuns: "sometimes"}
+	schedule, location, err := c.schedule()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if _, err := c.dueTimes(schedule, location, now, now, now); err == nil {
+		t.Error("dueTimes() succeeded, want an error")
+	}
+}
+
+func TestCronjobNextRun(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		cronjob Cronjob
+		want    time.Time
+	}{
+		{
+			name:    "utc",
+			cronjob: Cronjob{Expression: "0 9 * * *", Timezone: "UTC"},
+			want:    time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			// 09:00 in Seoul is 00:00 UTC, which has passed at 00:30 UTC.
+			name:    "timezone",
+			cronjob: Cronjob{Expression: "0 9 * * *", Timezone: "Asia/Seoul"},
+			want:    time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "seconds",
+			cronjob: Cronjob{Expression: "*/15 * * * * *", Timezone: "UTC"},
+			want:    now.Add(15 * time.Second),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, location, err := tt.cronjob.schedule()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			scheduledAt, runAt := tt.cronjob.nextRun(schedule, location, now)
+			if !scheduledAt.Equal(tt.want) || !runAt.Equal(tt.want) {
+				t.Errorf("nextRun() = %s, %s, want %s for both", scheduledAt, runAt, tt.want)
+			}
+		})
+	}
+}
+
+func TestCronjobNextRunJitter(t *testing.T) {
+	c := Cronjob{Expression: "0 9 * * *", Timezone: "UTC", JitterSeconds: 60}
+	schedule, location, err := c.schedule()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 100; i++ {
+		scheduledAt, runAt := c.nextRun(schedule, location, now)
+		if delay := runAt.Sub(scheduledAt); delay < 0 || delay >= time.Minute {
+			t.Fatalf("nextRun() jitter = %s, want within [0, 1m)", delay)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+var heartbeatInterval = 15 * time.Second
+var staleTaskThreshold = 2 * time.Minute
+
+// heartbeat keeps the claimed task's heartbeat_at fresh until ctx is done, so
+// the reaper can tell it apart from a task whose worker died.
+func heartbeat(ctx context.Context, taskID string) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		_, err := db.Exec("UPDATE tasks SET heartbeat_at = NOW() WHERE id = $1 AND worker_id = $2 AND status = 'running'", taskID, workerID)
+		if err != nil {
+			log.Println("heartbeat failed", taskID, err)
+		}
+	}
+}
+
+// reapStaleTasks ends the attempt of every running task whose heartbeat is
+// older than staleTaskThreshold. Like any failed attempt, the task is retried
+// while its function has attempts left.
+func reapStaleTasks() (err error) {
+	rows, err := db.Query(`WITH stale AS (
+	SELECT t.id, t.attempts, t.worker_id, t.started_at, f.max_attempts
+	FROM tasks t JOIN functions f ON f.id = t.function_id
+	WHERE t.status = 'running' AND t.heartbeat_at < NOW() - $1 * INTERVAL '1 second'
+	FOR UPDATE OF t SKIP LOCKED
+), recorded AS (
+	INSERT INTO task_attempts (task_id, attempt, worker_id, status, error, started_at, finished_at)
+	SELECT id, attempts, worker_id, 'failed', 'worker heartbeat lost', started_at, NOW() FROM stale
+)
+UPDATE tasks t SET
+	status = CASE WHEN s.max_attempts <= 1 THEN 'failed' WHEN s.attempts >= s.max_attempts THEN 'dead' ELSE 'retrying' END,
+	error = 'worker heartbeat lost',
+	run_after = NOW(),
+	done_at = CASE WHEN s.max_attempts <= 1 OR s.attempts >= s.max_attempts THEN NOW() END
+FROM stale s
+WHERE t.id = s.id
+RETURNING t.id, COALESCE(s.worker_id, ''), t.status`, staleTaskThreshold.Seconds())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, staleWorkerID, status string
+		err = rows.Scan(&id, &staleWorkerID, &status)
+		if err != nil {
+			return
+		}
+
+		log.Printf("reaped task %s of %s, now %s", id, staleWorkerID, status)
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	bus_tracker "github.com/ariyn/bus-tracker"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+var _ bus_tracker.History = taskHistory{}
+
+// taskHistory looks up the earlier tasks of a function, leaving out the task
+// being run.
+type taskHistory struct {
+	functionID string
+	taskID     string
+}
+
+// previousImagePage is how many results PreviousImage reads at a time.
+const previousImagePage = 10
+
+// PreviousImage returns the first image of the latest successful run that
+// returned one, so a run without an image doesn't reset visual diffs.
+func (h taskHistory) PreviousImage(ctx context.Context) (*bus_tracker.Image, error) {
+	var saved *btImage
+	var before *taskCursor
+	for saved == nil {
+		results, next, err := h.imageResults(ctx, before)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, result := range results {
+			var v interface{}
+			if json.Unmarshal([]byte(result), &v) == nil {
+				saved = findImage(v)
+			}
+			if saved != nil {
+				break
+			}
+		}
+
+		if next == nil {
+			break
+		}
+		before = next
+	}
+
+	if saved == nil {
+		return nil, nil
+	}
+
+	body, err := loadImage(ctx, saved.BtImage)
+	if err != nil {
+		return nil, fmt.Errorf("could not load previous image: %v", err)
+	}
+
+	return &bus_tracker.Image{
+		Url:         saved.OriginalUrl,
+		Name:        saved.BtImage.Key,
+		ContentType: http.DetectContentType(body),
+		Body:        body,
+	}, nil
+}
+
+// taskCursor is where the next page of imageResults starts.
+type taskCursor struct {
+	createdAt time.Time
+	id        string
+}
+
+// imageResults returns a page of successful results that may hold an image,
+// newest first, starting after before. next is nil on the last page.
+//
+// The page walks tasks_function_id_idx, so the latest results are read
+// without sorting the function's whole history. Results are written by
+// json.Marshal, which leaves no spaces, so the LIKE narrows the page down to
+// results with an image in them.
+func (h taskHistory) imageResults(ctx context.Context, before *taskCursor) (results []string, next *taskCursor, err error) {
+	var createdAt, id interface{}
+	if before != nil {
+		createdAt, id = before.createdAt, before.id
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT result, created_at, id FROM tasks
+WHERE function_id = $1 AND id <> $2 AND status = 'succeeded' AND result LIKE '%"type":"image"%'
+AND ($3::timestamptz IS NULL OR (created_at, id) < ($3, $4::uuid))
+ORDER BY created_at DESC, id DESC LIMIT $5`, h.functionID, h.taskID, createdAt, id, previousImagePage)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var last taskCursor
+	for rows.Next() {
+		var result string
+		err = rows.Scan(&result, &last.createdAt, &last.id)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		results = append(results, result)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(results) == previousImagePage {
+		next = &last
+	}
+
+	return results, next, nil
+}
+
+// findImage returns the first image saved by saveAndReplaceImages in a
+// decoded result. Dictionaries are searched in key order, so the same image
+// is found every time.
+func findImage(v interface{}) *btImage {
+	switch v := v.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if image := findImage(item); image != nil {
+				return image
+			}
+		}
+	case map[string]interface{}:
+		if data, ok := v["_bt_data"].(map[string]interface{}); ok && data["type"] == "image" {
+			image := &btImage{}
+			image.BtImage.Url, _ = data["url"].(string)
+			image.BtImage.Key, _ = data["key"].(string)
+			image.OriginalUrl, _ = v["original_url"].(string)
+			return image
+		}
+
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if image := findImage(v[k]); image != nil {
+				return image
+			}
+		}
+	}
+
+	return nil
+}
+
+// loadImage reads a saved image from imageStorage, or from its URL for
+// results saved before keys were recorded.
+func loadImage(ctx context.Context, data btData) ([]byte, error) {
+	if data.Key != "" {
+		return imageStorage.Get(ctx, data.Key)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, data.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("GET %s: %s", data.Url, resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
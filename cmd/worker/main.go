@@ -1,26 +1,44 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	bus_tracker "github.com/ariyn/bus-tracker"
-	"github.com/google/uuid"
+	"github.com/ariyn/bus-tracker/storage"
+	lox "github.com/ariyn/lox_interpreter"
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
-	"github.com/robfig/cron/v3"
-	storage_go "github.com/supabase-community/storage-go"
+	"github.com/lib/pq"
+	"io/fs"
 	"log"
 	"os"
+	"os/signal"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 var db *sql.DB
+var imageStorage storage.Storage
+var retryPolicy bus_tracker.RetryPolicy
+var scriptTimeout = 5 * time.Minute
+var workerID string
+
+// taskChannel is notified by the tasks insert trigger.
+const taskChannel = "tasks_inserted"
+
+var taskPollInterval = 30 * time.Second
 
 func init() {
+	// The environment may come from elsewhere than .env, e.g. in tests.
 	err := godotenv.Load()
-	if err != nil {
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		log.Fatal("Error loading .env file", err)
 	}
 
@@ -29,102 +47,330 @@ func init() {
 		log.Fatal(err)
 	}
 
-	log.Println(os.Getenv("SUPABASE_SERVICE_KEY"))
-	bus_tracker.StorageClient = storage_go.NewClient(os.Getenv("SUPABASE_STORAGE_BASE_URL"), os.Getenv("SUPABASE_SERVICE_KEY"), nil)
+	if timeout := os.Getenv("SCRIPT_TIMEOUT"); timeout != "" {
+		scriptTimeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			log.Fatal("invalid SCRIPT_TIMEOUT", err)
+		}
+	}
+
+	if interval := os.Getenv("TASK_POLL_INTERVAL"); interval != "" {
+		taskPollInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			log.Fatal("invalid TASK_POLL_INTERVAL", err)
+		}
+	}
+
+	if interval := os.Getenv("HEARTBEAT_INTERVAL"); interval != "" {
+		heartbeatInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			log.Fatal("invalid HEARTBEAT_INTERVAL", err)
+		}
+	}
+
+	if threshold := os.Getenv("STALE_TASK_THRESHOLD"); threshold != "" {
+		staleTaskThreshold, err = time.ParseDuration(threshold)
+		if err != nil {
+			log.Fatal("invalid STALE_TASK_THRESHOLD", err)
+		}
+	}
+
+	if staleTaskThreshold <= heartbeatInterval {
+		log.Fatalf("STALE_TASK_THRESHOLD (%s) must be longer than HEARTBEAT_INTERVAL (%s)", staleTaskThreshold, heartbeatInterval)
+	}
+
+	workerID = os.Getenv("WORKER_ID")
+	if workerID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "worker"
+		}
+		workerID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+
+	imageStorage, err = storage.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	browserStateKey, err = bus_tracker.BrowserStateKeyFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	retryPolicy, err = bus_tracker.RetryPolicyFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 type function struct {
-	functionID string
-	taskID     string
-	code       string
-	envVar     map[string]string
+	functionID   string
+	taskID       string
+	code         string
+	envVar       map[string]string
+	attempt      int
+	maxAttempts  int
+	retryBackoff time.Duration
 }
 
+var concurrency = flag.Int("concurrency", 0, "number of tasks run at once, overrides WORKER_CONCURRENCY")
+
 func main() {
+	flag.Parse()
 	defer db.Close()
 
+	if flag.Arg(0) == "migrate" {
+		err := runMigrate(flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "state" {
+		err := runState(flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	workers, err := workerConcurrency()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	poolOptions, err := bus_tracker.BrowserPoolOptionsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bus_tracker.Browsers, err = bus_tracker.NewBrowserPool(poolOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), scriptTimeout)
+		defer cancel()
+
+		err := bus_tracker.Browsers.Close(closeCtx)
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+
 	wg := sync.WaitGroup{}
 
-	queue := make(chan *function, 100)
+	// A task is only claimed once one of the slots, one per worker, is free,
+	// so a claimed task is never left waiting for a worker while the reaper
+	// thinks its worker died.
+	queue := make(chan *function)
+	slots := make(chan struct{}, workers)
 
-	cronTicker := time.NewTicker(1 * time.Minute)
-	defer cronTicker.Stop()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		scheduleCronjobs(ctx)
+	}()
 
+	wg.Add(1)
 	go func() {
-		wg.Add(1)
 		defer wg.Done()
 
-		for range cronTicker.C {
-			err := getCronjob()
+		reapTicker := time.NewTicker(staleTaskThreshold / 2)
+		defer reapTicker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-reapTicker.C:
+			}
+
+			err := reapStaleTasks()
 			if err != nil {
 				log.Println(err)
 			}
 		}
 	}()
 
-	taskTicker := time.NewTicker(1 * time.Second)
-	defer taskTicker.Stop()
+	listener, err := listenForTasks()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer listener.Close()
 
-	go func(queue chan<- *function) {
+	go dispatchTasks(ctx, queue, slots, listener.Notify)
+
+	log.Printf("starting %d workers", workers)
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
-		defer wg.Done()
-		for range taskTicker.C {
-			f, err := getTask()
-			if err == sql.ErrNoRows {
-				continue
+		go func() {
+			defer wg.Done()
+
+			for f := range queue {
+				runTask(f)
+				<-slots
 			}
+		}()
+	}
 
+	wg.Wait()
+	log.Println("all workers stopped")
+}
+
+// workerConcurrency returns the number of workers from the -concurrency flag,
+// then WORKER_CONCURRENCY, defaulting to 4.
+func workerConcurrency() (n int, err error) {
+	n = *concurrency
+	if n == 0 {
+		n = 4
+		if v := os.Getenv("WORKER_CONCURRENCY"); v != "" {
+			n, err = strconv.Atoi(v)
 			if err != nil {
-				log.Println(err)
-				continue
+				return 0, fmt.Errorf("invalid WORKER_CONCURRENCY: %v", err)
 			}
+		}
+	}
+
+	if n < 1 {
+		return 0, fmt.Errorf("concurrency must be at least 1, but got %d", n)
+	}
 
-			log.Printf("RUN %s for %s", f.taskID, f.functionID)
-			queue <- f
+	return n, nil
+}
+
+// dispatchTasks claims pending tasks and hands them to the workers until ctx
+// is done, then closes queue so the workers exit after their current task.
+// It takes a slot before claiming a task, and the worker gives it back once
+// the task is finished.
+// It wakes up on every notification from the task trigger, and every
+// taskPollInterval for tasks a notification can't announce, such as retries
+// whose run_after has passed.
+func dispatchTasks(ctx context.Context, queue chan<- *function, slots chan struct{}, notifications <-chan *pq.Notification) {
+	defer close(queue)
+
+	taskTicker := time.NewTicker(taskPollInterval)
+	defer taskTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-notifications:
+		case <-taskTicker.C:
 		}
-	}(queue)
 
-	// TODO: This does not run parallel. It should be run in parallel.
-	for f := range queue {
-		runScript(f.taskID, f.code, f.envVar)
+		for ctx.Err() == nil {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			f, err := getTask()
+			if err != nil {
+				<-slots
+				if err != sql.ErrNoRows {
+					log.Println(err)
+				}
+				break
+			}
+
+			select {
+			case queue <- f:
+				log.Printf("RUN %s for %s", f.taskID, f.functionID)
+			case <-ctx.Done():
+				releaseTask(f.taskID)
+				return
+			}
+		}
 	}
 }
 
-func getTask() (f *function, err error) {
-	row := db.QueryRow("SELECT id, function_id from tasks WHERE done_at IS NULL AND status = 'pending'")
-	err = row.Err()
+// listenForTasks subscribes to taskChannel. The listener reconnects on its
+// own; a nil notification is sent after a reconnect, which also wakes the
+// dispatcher to pick up anything inserted while disconnected.
+func listenForTasks() (listener *pq.Listener, err error) {
+	listener = pq.NewListener(os.Getenv("DATABASE_URL"), 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("task listener:", err)
+		}
+	})
+
+	err = listener.Listen(taskChannel)
 	if err != nil {
-		return
+		_ = listener.Close()
+		return nil, err
 	}
 
-	var functionID, taskID string
-	err = row.Scan(&taskID, &functionID)
+	return listener, nil
+}
+
+// runTask runs a claimed task, recovering from panics so one broken script
+// can't take the worker down.
+func runTask(f *function) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("task %s panicked: %v\n%s", f.taskID, r, debug.Stack())
+			finishTask(f, "", fmt.Errorf("panic: %v", r))
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go heartbeat(ctx, f.taskID)
+
+	result, err := runScript(f)
+	finishTask(f, result, err)
+}
+
+// releaseTask puts a claimed task that never started back to pending.
+func releaseTask(id string) {
+	_, err := db.Exec("UPDATE tasks SET status = 'pending', started_at = NULL, worker_id = NULL, attempts = attempts - 1 WHERE id = $1", id)
 	if err != nil {
-		return
+		log.Println(err)
 	}
+}
+
+// getTask claims the next runnable task for this worker. Locked rows are
+// skipped, so several worker processes can claim from the same table without
+// taking the same task twice.
+func getTask() (f *function, err error) {
+	row := db.QueryRow(`UPDATE tasks SET status = 'running', started_at = NOW(), heartbeat_at = NOW(), worker_id = $1, attempts = attempts + 1
+WHERE id = (
+	SELECT id FROM tasks
+	WHERE done_at IS NULL AND status IN ('pending', 'retrying') AND (run_after IS NULL OR run_after <= NOW())
+	ORDER BY priority DESC, created_at
+	LIMIT 1
+	FOR UPDATE SKIP LOCKED
+)
+RETURNING id, function_id, attempts`, workerID)
 
-	envVar, err := getEnvironmentVariables(functionID)
+	f = &function{}
+	err = row.Scan(&f.taskID, &f.functionID, &f.attempt)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	_, err = db.Exec("UPDATE tasks SET status = 'running', started_at = NOW() WHERE id = $1", taskID)
+	f.envVar, err = getEnvironmentVariables(f.functionID)
 	if err != nil {
-		return
+		finishTask(f, "", err)
+		return nil, err
 	}
 
-	code, err := getCode(functionID)
+	f.code, f.maxAttempts, f.retryBackoff, err = getFunction(f.functionID)
 	if err != nil {
-		return
+		finishTask(f, "", err)
+		return nil, err
 	}
 
-	return &function{
-		functionID: functionID,
-		taskID:     taskID,
-		code:       code,
-		envVar:     envVar,
-	}, nil
-
+	return f, nil
 }
 
 func getEnvironmentVariables(functionId string) (map[string]string, error) {
@@ -149,156 +395,116 @@ func getEnvironmentVariables(functionId string) (map[string]string, error) {
 	return envVar, nil
 }
 
-func getCode(functionId string) (code string, err error) {
-	row := db.QueryRow("SELECT code FROM functions WHERE id = $1", functionId)
+func getFunction(functionId string) (code string, maxAttempts int, retryBackoff time.Duration, err error) {
+	row := db.QueryRow("SELECT code, max_attempts, retry_backoff_seconds FROM functions WHERE id = $1", functionId)
 	err = row.Err()
 	if err != nil {
 		return
 	}
 
-	err = row.Scan(&code)
+	var backoffSeconds int
+	err = row.Scan(&code, &maxAttempts, &backoffSeconds)
+	retryBackoff = time.Duration(backoffSeconds) * time.Second
 	return
 }
 
-type Cronjob struct {
-	Expression string
-	Minutes    []int
-	Hours      []int
-	DayOfMonth []int
-	DaysOfWeek []int
-	Month      []int
-}
-
-func getCronjob() (err error) {
-	rows, err := db.Query("SELECT id, function_id, crontab FROM crontabs WHERE next_run_at < NOW()")
+func runScript(f *function) (result string, err error) {
+	states, err := browserStates(f.functionID)
 	if err != nil {
-		log.Println(err)
-		return
+		return "", err
 	}
 
-	defer rows.Close()
-	for rows.Next() {
-		var id, functionId, crontabString string
-		err = rows.Scan(&id, &functionId, &crontabString)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-
-		_, err = db.Exec("INSERT INTO tasks (function_id, status, user_id, cron_id) VALUES ($1, 'pending', (SELECT user_id FROM crontabs WHERE id = $2), $2)", functionId, id)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-
-		var cronjob Cronjob
-		err = json.Unmarshal([]byte(crontabString), &cronjob)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-
-		parser := cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow)
-		result, err := parser.Parse(cronjob.Expression)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-
-		next := result.Next(time.Now())
-		_, err = db.Exec("UPDATE crontabs SET next_run_at = $1 WHERE id = $2", next, id)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-	}
-
-	return
-}
-
-func runScript(id string, code string, envVar map[string]string) {
-	defer func() {
-		_, err := db.Exec("UPDATE tasks SET done_at = NOW(), status='done' WHERE id = $1", id)
-
-		if err != nil {
-			log.Println(err)
-		}
-	}()
-
-	bts, err := bus_tracker.NewBusTrackerScript(code, envVar)
+	bts, err := bus_tracker.NewBusTrackerScript(f.code, f.envVar, bus_tracker.ScriptOptions{
+		Storage: imageStorage,
+		History: taskHistory{functionID: f.functionID, taskID: f.taskID},
+		States:  states,
+		Retry:   &retryPolicy,
+		Logger:  log.New(log.Writer(), fmt.Sprintf("task %s: ", f.taskID), log.Flags()|log.Lmsgprefix),
+	})
 	if err != nil {
 		log.Println("error raised", err)
-		writeResult(id, "", err)
-		return
+		return "", err
 	}
 
-	v, err := bts.Run()
+	ctx, cancel := context.WithTimeout(context.Background(), scriptTimeout)
+	defer cancel()
+
+	v, err := bts.Run(ctx)
+	var timeoutErr *bus_tracker.TimeoutError
+	if errors.As(err, &timeoutErr) {
+		log.Printf("task %s timed out after %s", f.taskID, scriptTimeout)
+		return "", err
+	}
 	if err != nil {
 		log.Println("error returned", err)
-		writeResult(id, "", err)
-		return
+		return "", err
 	}
 
 	log.Printf("returned %#v", v)
 
-	v, err = saveAndReplaceImages(v)
+	v, err = saveAndReplaceImages(ctx, v)
 	if err != nil {
-		writeResult(id, "", err)
-		return
+		return "", err
 	}
 
 	if str, ok := v.(string); ok {
-		writeResult(id, str, nil)
-		return
+		return str, nil
 	}
 
 	b, err := json.Marshal(v)
 	if err != nil {
-		writeResult(id, "", err)
-		return
+		return "", err
 	}
 
-	writeResult(id, string(b), nil)
-	return
+	return string(b), nil
 }
 
 type btImage struct {
-	BtImage struct {
-		Type string `json:"type"`
-		Url  string `json:"url"`
-	} `json:"_bt_data"`
+	BtImage     btData `json:"_bt_data"`
 	OriginalUrl string `json:"original_url"`
 }
 
-func saveAndReplaceImages(v interface{}) (replacedV interface{}, err error) {
-	if image, ok := v.(*bus_tracker.Image); ok {
-		path := uuid.New().String()
+type btData struct {
+	Type string `json:"type"`
+	Url  string `json:"url"`
+	// Key is where the file is kept in imageStorage.
+	Key string `json:"key,omitempty"`
+}
 
-		_, err := bus_tracker.StorageClient.UploadFile("images", path, bytes.NewReader(image.Body), storage_go.FileOptions{
-			ContentType: &image.ContentType,
-		})
+func saveAndReplaceImages(ctx context.Context, v interface{}) (replacedV interface{}, err error) {
+	if image, ok := v.(*bus_tracker.Image); ok {
+		publicUrl, err := image.Save(ctx, imageStorage)
 		if err != nil {
 			return nil, err
 		}
+		dataType := "image"
+		if !strings.HasPrefix(image.ContentType, "image/") {
+			dataType = "file"
+		}
 
-		publicUrl := bus_tracker.StorageClient.GetPublicUrl("images", path)
 		return btImage{
-			BtImage: struct {
-				Type string `json:"type"`
-				Url  string `json:"url"`
-			}{
-				Type: "image",
-				Url:  publicUrl.SignedURL,
+			BtImage: btData{
+				Type: dataType,
+				Url:  publicUrl,
+				Key:  image.Key(),
 			},
 			OriginalUrl: image.Url,
 		}, nil
 
 	}
 
+	if list, ok := v.(lox.ListType); ok {
+		v = []interface{}(list)
+	}
+
+	if dict, ok := v.(lox.DictType); ok {
+		v = map[string]interface{}(dict)
+	}
+
 	if arr, ok := v.([]interface{}); ok {
 		var replacedArr []interface{}
 		for _, item := range arr {
-			replacedItem, err := saveAndReplaceImages(item)
+			replacedItem, err := saveAndReplaceImages(ctx, item)
 			if err != nil {
 				return nil, err
 			}
@@ -312,7 +518,7 @@ func saveAndReplaceImages(v interface{}) (replacedV interface{}, err error) {
 	if m, ok := v.(map[string]interface{}); ok {
 		replacedM := make(map[string]interface{})
 		for k, item := range m {
-			replacedItem, err := saveAndReplaceImages(item)
+			replacedItem, err := saveAndReplaceImages(ctx, item)
 			if err != nil {
 				return nil, err
 			}
@@ -325,16 +531,3 @@ func saveAndReplaceImages(v interface{}) (replacedV interface{}, err error) {
 
 	return v, nil
 }
-
-func writeResult(id string, result string, err error) {
-	log.Println(id, result, err)
-	errorString := ""
-	if err != nil {
-		errorString = err.Error()
-	}
-
-	_, insertErr := db.Exec("UPDATE tasks SET result = $1, error = $2 WHERE id = $3", result, errorString, id)
-	if insertErr != nil {
-		log.Println(insertErr)
-	}
-}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ariyn/bus-tracker/migrations"
+	"log"
+	"strconv"
+)
+
+// runMigrate handles `worker migrate up|down [steps]|status`.
+func runMigrate(args []string) (err error) {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: worker migrate up|down [steps]|status")
+	}
+
+	switch args[0] {
+	case "up":
+		done, err := migrations.Up(db)
+		for _, m := range done {
+			log.Printf("applied %04d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(done) == 0 {
+			log.Println("already up to date")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("down needs a positive number of steps, but got %s", args[1])
+			}
+		}
+
+		done, err := migrations.Down(db, steps)
+		for _, m := range done {
+			log.Printf("reverted %04d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+	case "status":
+		statuses, err := migrations.Statuses(db)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range statuses {
+			appliedAt := "pending"
+			if s.AppliedAt != nil {
+				appliedAt = s.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+
+			fmt.Printf("%04d_%-30s %s\n", s.Version, s.Name, appliedAt)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %s", args[0])
+	}
+
+	return nil
+}
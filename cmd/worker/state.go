@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	bus_tracker "github.com/ariyn/bus-tracker"
+	"log"
+)
+
+// browserStateKey encrypts browser states. States are not kept when it is
+// not set.
+var browserStateKey []byte
+
+var _ bus_tracker.BrowserStates = functionStates{}
+
+// functionStates keeps the browser states of one function in browser_states.
+type functionStates struct {
+	functionID string
+}
+
+func (s functionStates) LoadState(ctx context.Context, key string) (state []byte, err error) {
+	err = db.QueryRowContext(ctx, "SELECT state FROM browser_states WHERE function_id = $1 AND key = $2", s.functionID, key).Scan(&state)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return state, err
+}
+
+func (s functionStates) SaveState(ctx context.Context, key string, state []byte) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO browser_states (function_id, key, state) VALUES ($1, $2, $3)
+ON CONFLICT (function_id, key) DO UPDATE SET state = EXCLUDED.state, updated_at = NOW()`, s.functionID, key, state)
+	return err
+}
+
+// browserStates returns the encrypted states of the function, or nil when
+// states are not kept.
+func browserStates(functionID string) (bus_tracker.BrowserStates, error) {
+	if browserStateKey == nil {
+		return nil, nil
+	}
+
+	return bus_tracker.NewEncryptedStates(functionStates{functionID: functionID}, functionID, browserStateKey)
+}
+
+// runState handles `worker state clear <function-id> [key]`, which forgets
+// one or every browser state of a function, e.g. to force a new login.
+func runState(args []string) (err error) {
+	if len(args) < 2 || len(args) > 3 || args[0] != "clear" {
+		return fmt.Errorf("usage: worker state clear <function-id> [key]")
+	}
+
+	var result sql.Result
+	if len(args) == 3 {
+		result, err = db.Exec("DELETE FROM browser_states WHERE function_id = $1 AND key = $2", args[1], args[2])
+	} else {
+		result, err = db.Exec("DELETE FROM browser_states WHERE function_id = $1", args[1])
+	}
+	if err != nil {
+		return
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return
+	}
+
+	log.Printf("cleared %d browser states of %s", n, args[1])
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Task states. A task starts pending and is claimed into running. A finished
+// attempt moves it to succeeded, or on error to retrying while attempts are
+// left. Once they are used up it ends in dead, or in failed when its function
+// does not retry at all. cancelled is set from outside and is never
+// overwritten by a worker.
+const (
+	statusPending   = "pending"
+	statusRunning   = "running"
+	statusSucceeded = "succeeded"
+	statusFailed    = "failed"
+	statusRetrying  = "retrying"
+	statusCancelled = "cancelled"
+	statusDead      = "dead"
+)
+
+const defaultRetryBackoff = 30 * time.Second
+const maxRetryBackoff = 1 * time.Hour
+
+// nextStatus decides where a task goes after an attempt that ended with err.
+func nextStatus(f *function, err error) string {
+	if err == nil {
+		return statusSucceeded
+	}
+
+	if f.maxAttempts <= 1 {
+		return statusFailed
+	}
+
+	if f.attempt >= f.maxAttempts {
+		return statusDead
+	}
+
+	return statusRetrying
+}
+
+// retryDelay is the exponential backoff before the next attempt: the
+// function's backoff doubled for every attempt already made, capped at
+// maxRetryBackoff.
+func retryDelay(f *function) time.Duration {
+	delay := f.retryBackoff
+	if delay <= 0 {
+		delay = defaultRetryBackoff
+	}
+
+	for i := 1; i < f.attempt && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+
+	return min(delay, maxRetryBackoff)
+}
+
+// finishTask moves the task to its next state and records the attempt. A task
+// that is no longer running for this worker, e.g. cancelled or reaped
+// meanwhile, keeps its state and the attempt is left to whoever changed it.
+func finishTask(f *function, result string, err error) {
+	log.Println(f.taskID, result, err)
+
+	status := nextStatus(f, err)
+	errorString := ""
+	if err != nil {
+		errorString = err.Error()
+	}
+
+	var runAfter *time.Time
+	if status == statusRetrying {
+		t := time.Now().Add(retryDelay(f))
+		runAfter = &t
+		log.Printf("task %s failed attempt %d/%d, retrying at %s", f.taskID, f.attempt, f.maxAttempts, t.Format(time.RFC3339))
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	attemptStatus := statusSucceeded
+	if errorString != "" {
+		attemptStatus = statusFailed
+	}
+
+	var startedAt sql.NullTime
+	err = tx.QueryRow(`UPDATE tasks SET status = $2, result = $3, error = $4, run_after = $5,
+	done_at = CASE WHEN $2 IN ('succeeded', 'failed', 'dead') THEN NOW() END
+WHERE id = $1 AND status = 'running' AND worker_id = $6 AND attempts = $7
+RETURNING started_at`, f.taskID, status, result, errorString, runAfter, workerID, f.attempt).Scan(&startedAt)
+	if err == sql.ErrNoRows {
+		log.Printf("task %s is no longer running attempt %d for this worker, not recording it", f.taskID, f.attempt)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	_, err = tx.Exec(`INSERT INTO task_attempts (task_id, attempt, worker_id, status, error, started_at, finished_at)
+VALUES ($1, $2, $3, $4, $5, $6, NOW())
+ON CONFLICT DO NOTHING`, f.taskID, f.attempt, workerID, attemptStatus, errorString, startedAt)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+	}
+}
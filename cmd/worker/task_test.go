@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNextStatus(t *testing.T) {
+	failed := errors.New("failed")
+
+	tests := []struct {
+		name        string
+		attempt     int
+		maxAttempts int
+		err         error
+		want        string
+	}{
+		{name: "succeeded", attempt: 1, maxAttempts: 3, want: statusSucceeded},
+		{name: "succeeded on last attempt", attempt: 3, maxAttempts: 3, want: statusSucceeded},
+		{name: "no retries", attempt: 1, maxAttempts: 1, err: failed, want: statusFailed},
+		{name: "no retries configured", attempt: 1, maxAttempts: 0, err: failed, want: statusFailed},
+		{name: "attempts left", attempt: 1, maxAttempts: 3, err: failed, want: statusRetrying},
+		{name: "last attempt", attempt: 3, maxAttempts: 3, err: failed, want: statusDead},
+		{name: "past last attempt", attempt: 4, maxAttempts: 3, err: failed, want: statusDead},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &function{attempt: tt.attempt, maxAttempts: tt.maxAttempts}
+			if got := nextStatus(f, tt.err); got != tt.want {
+				t.Errorf("nextStatus() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		attempt int
+		backoff time.Duration
+		want    time.Duration
+	}{
+		{name: "first retry", attempt: 1, backoff: 10 * time.Second, want: 10 * time.Second},
+		{name: "doubles", attempt: 2, backoff: 10 * time.Second, want: 20 * time.Second},
+		{name: "doubles again", attempt: 4, backoff: 10 * time.Second, want: 80 * time.Second},
+		{name: "default backoff", attempt: 1, want: defaultRetryBackoff},
+		{name: "negative backoff", attempt: 2, backoff: -time.Second, want: 2 * defaultRetryBackoff},
+		{name: "capped", attempt: 20, backoff: 10 * time.Second, want: maxRetryBackoff},
+		{name: "capped far out", attempt: 1000, backoff: 10 * time.Second, want: maxRetryBackoff},
+		{name: "backoff over cap", attempt: 1, backoff: 2 * maxRetryBackoff, want: maxRetryBackoff},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &function{attempt: tt.attempt, retryBackoff: tt.backoff}
+			if got := retryDelay(f); got != tt.want {
+				t.Errorf("retryDelay() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package bus_tracker
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/ariyn/bus-tracker/functions"
@@ -19,22 +20,33 @@ var _ lox.Callable = (*GetFunction)(nil)
 type GetFunction struct {
 }
 
-func (g GetFunction) Call(_ *lox.Interpreter, arguments []interface{}) (v interface{}, err error) {
+func (g GetFunction) Call(i *lox.Interpreter, arguments []interface{}) (v interface{}, err error) {
 	url, ok := arguments[0].(string)
 	if !ok {
 		err = fmt.Errorf("get() 1st argument need string, but got %v", arguments[0])
 		return
 	}
 
-	resp, err := http.Get(url)
-	if err != nil {
+	if _, err = absoluteUrl("get", url); err != nil {
 		return
 	}
-	defer resp.Body.Close()
 
-	contentType := resp.Header.Get("Content-Type")
+	r := &httpRequest{
+		method:  http.MethodGet,
+		url:     url,
+		headers: make(http.Header),
+	}
+
+	return r.send(i, http.DefaultClient)
+}
+
+// responseValue converts a response body by its content type: JSON and HTML
+// into CrawlData, images into an Image. url names the image when the response
+// has no Content-Disposition.
+func responseValue(url string, header http.Header, body []byte) (v interface{}, err error) {
+	contentType := header.Get("Content-Type")
 	if strings.HasPrefix(contentType, "application/json") {
-		body, err := convertJsonToXmlString(resp.Body)
+		body, err := convertJsonToXmlString(bytes.NewReader(body))
 		if err != nil {
 			return nil, err
 		}
@@ -47,11 +59,6 @@ func (g GetFunction) Call(_ *lox.Interpreter, arguments []interface{}) (v interf
 	}
 
 	if strings.HasPrefix(contentType, "text/html") {
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
-		}
-
 		instance, err := functions.NewCrawlDataInstance(string(body))
 		if err != nil {
 			return nil, err
@@ -60,12 +67,7 @@ func (g GetFunction) Call(_ *lox.Interpreter, arguments []interface{}) (v interf
 	}
 
 	if strings.HasPrefix(contentType, "image/") {
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
-		}
-
-		name := resp.Header.Get("Content-Disposition")
+		name := header.Get("Content-Disposition")
 		if name == "" {
 			tokens := strings.Split(url, "/")
 			name = tokens[len(tokens)-1]
@@ -76,7 +78,7 @@ func (g GetFunction) Call(_ *lox.Interpreter, arguments []interface{}) (v interf
 			}
 		}
 
-		return NewImageInstance(&Image{Body: body, Url: url, ContentType: resp.Header.Get("Content-Type"), Name: name}), nil
+		return NewImageInstance(&Image{Body: body, Url: url, ContentType: contentType, Name: name}), nil
 	}
 
 	return nil, fmt.Errorf("Content-Type %s is not supported", contentType)
@@ -3,6 +3,7 @@ module github.com/ariyn/bus-tracker
 go 1.23
 
 require (
+	github.com/HugoSmits86/nativewebp v0.9.3
 	github.com/PuerkitoBio/goquery v1.10.0
 	github.com/ariyn/lox_interpreter v0.0.0-20241106123216-fb40730085a5
 	github.com/boltdb/bolt v1.3.1
@@ -11,7 +12,12 @@ require (
 	github.com/labstack/echo/v4 v4.12.0
 	github.com/lib/pq v1.10.9
 	github.com/playwright-community/playwright-go v0.4702.0
+	github.com/robfig/cron/v3 v3.0.1
+	github.com/supabase-community/storage-go v0.7.0
 	github.com/tidwall/gjson v1.18.0
+	golang.org/x/image v0.21.0
+	golang.org/x/net v0.29.0
+	golang.org/x/text v0.19.0
 )
 
 require (
@@ -23,8 +29,6 @@ require (
 	github.com/labstack/gommon v0.4.2 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
-	github.com/robfig/cron/v3 v3.0.1 // indirect
-	github.com/supabase-community/storage-go v0.7.0 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.1 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
@@ -32,8 +36,6 @@ require (
 	go.uber.org/multierr v1.11.0 // indirect
 	golang.org/x/crypto v0.27.0 // indirect
 	golang.org/x/exp v0.0.0-20241009180824-f66d83c29e7c // indirect
-	golang.org/x/net v0.29.0 // indirect
 	golang.org/x/sys v0.26.0 // indirect
-	golang.org/x/text v0.18.0 // indirect
 	golang.org/x/time v0.5.0 // indirect
 )
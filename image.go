@@ -2,14 +2,14 @@ package bus_tracker
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"github.com/ariyn/bus-tracker/storage"
 	lox "github.com/ariyn/lox_interpreter"
-	"github.com/google/uuid"
-	storage_go "github.com/supabase-community/storage-go"
 )
 
-var StorageClient *storage_go.Client
-
 type Image struct {
 	Url         string
 	Name        string
@@ -20,7 +20,15 @@ type Image struct {
 func NewImageInstance(image *Image) *lox.LoxInstance {
 	instance := lox.NewLoxInstance(
 		lox.NewLoxClass("Image", nil, map[string]lox.Callable{
-			"save": newImageFunction("save", 0, save),
+			"save":      newImageFunction("save", 0, save),
+			"width":     newImageFunction("width", 0, width),
+			"height":    newImageFunction("height", 0, height),
+			"resize":    newImageFunction("resize", 2, resize),
+			"crop":      newImageFunction("crop", 4, crop),
+			"thumbnail": newImageFunction("thumbnail", 1, thumbnail),
+			"convert":   newImageFunction("convert", 2, convert),
+			"phash":     newImageFunction("phash", 0, phash),
+			"diff":      newImageFunction("diff", 1, diff),
 		}))
 
 	_ = instance.Set(lox.Token{Lexeme: "_image"}, lox.NewLiteralExpr(image))
@@ -28,7 +36,7 @@ func NewImageInstance(image *Image) *lox.LoxInstance {
 	return instance
 }
 
-type imageFunctionCall func(image *Image, arguments []any) (v interface{}, err error)
+type imageFunctionCall func(i *lox.Interpreter, image *Image, arguments []any) (v interface{}, err error)
 
 var _ lox.Callable = (*ImageFunction)(nil)
 
@@ -60,7 +68,7 @@ func (f ImageFunction) Call(i *lox.Interpreter, arguments []interface{}) (v inte
 		return nil, fmt.Errorf("is not Locator")
 	}
 
-	v, err = f.call(image.(*Image), arguments)
+	v, err = f.call(i, image.(*Image), arguments)
 
 	return v, err
 }
@@ -78,16 +86,51 @@ func (f ImageFunction) Bind(instance *lox.LoxInstance) lox.Callable {
 	return f
 }
 
-func save(image *Image, arguments []interface{}) (v interface{}, err error) {
-	path := uuid.New().String()
-	_, err = StorageClient.UploadFile("images", path, bytes.NewReader(image.Body), storage_go.FileOptions{
-		ContentType: &image.ContentType,
-	})
+var imageExtensions = map[string]string{
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"image/svg+xml":   ".svg",
+	"application/pdf": ".pdf",
+}
+
+// Key is where the image is stored: the SHA-256 of its body, so identical
+// images share one object and one URL.
+func (image *Image) Key() string {
+	sum := sha256.Sum256(image.Body)
+	return hex.EncodeToString(sum[:]) + imageExtensions[image.ContentType]
+}
+
+// Save uploads the image to store, unless an identical one is already
+// there, and returns its public URL.
+func (image *Image) Save(ctx context.Context, store storage.Storage) (url string, err error) {
+	if store == nil {
+		return "", fmt.Errorf("image storage is not configured")
+	}
+
+	key := image.Key()
+	exists, err := store.Exists(ctx, key)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	publicUrl := StorageClient.GetPublicUrl("images", path)
+	if !exists {
+		err = store.Put(ctx, key, bytes.NewReader(image.Body), storage.PutOptions{
+			ContentType: image.ContentType,
+			Metadata: map[string]string{
+				"filename":     image.Name,
+				"content-type": image.ContentType,
+			},
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return store.PublicURL(key), nil
+}
 
-	return publicUrl, nil
+func save(i *lox.Interpreter, image *Image, arguments []interface{}) (v interface{}, err error) {
+	return image.Save(scriptContext(i), scriptOptions(i).Storage)
 }
@@ -0,0 +1,199 @@
+package bus_tracker
+
+import (
+	"fmt"
+	lox "github.com/ariyn/lox_interpreter"
+	"golang.org/x/image/draw"
+	"image"
+	"image/color"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+const phashSize = 32
+const phashLowFrequencies = 8
+
+// diffThreshold is how far apart, out of 255, a channel of two pixels must be
+// for the pixel to count as changed. It keeps compression noise out of diffs.
+const diffThreshold = 32
+
+// phashOf computes a 64 bit DCT perceptual hash: the image is shrunk to a
+// 32x32 grayscale square, and each bit tells whether one of the 8x8 lowest
+// frequencies, DC excluded, is above their median.
+func phashOf(decoded image.Image) uint64 {
+	gray := image.NewGray(image.Rect(0, 0, phashSize, phashSize))
+	draw.ApproxBiLinear.Scale(gray, gray.Bounds(), decoded, decoded.Bounds(), draw.Src, nil)
+
+	var pixels [phashSize][phashSize]float64
+	for y := 0; y < phashSize; y++ {
+		for x := 0; x < phashSize; x++ {
+			pixels[y][x] = float64(gray.GrayAt(x, y).Y)
+		}
+	}
+
+	var frequencies []float64
+	for v := 0; v < phashLowFrequencies; v++ {
+		for u := 0; u < phashLowFrequencies; u++ {
+			if u == 0 && v == 0 {
+				continue
+			}
+
+			sum := 0.0
+			for y := 0; y < phashSize; y++ {
+				for x := 0; x < phashSize; x++ {
+					sum += pixels[y][x] *
+						math.Cos(float64(2*x+1)*float64(u)*math.Pi/(2*phashSize)) *
+						math.Cos(float64(2*y+1)*float64(v)*math.Pi/(2*phashSize))
+				}
+			}
+			frequencies = append(frequencies, sum)
+		}
+	}
+
+	sorted := append([]float64(nil), frequencies...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var hash uint64
+	for i, f := range frequencies {
+		if f > median {
+			hash |= 1 << uint(i)
+		}
+	}
+
+	return hash
+}
+
+// imageArgument unwraps the Image behind an Image instance passed to a
+// native.
+func imageArgument(name string, index int, arguments []any) (*Image, error) {
+	instance, ok := arguments[index].(*lox.LoxInstance)
+	if ok {
+		v, err := instance.Get(lox.Token{Lexeme: "_image"})
+		if img, isImage := v.(*Image); err == nil && isImage {
+			return img, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s() argument %d need Image, but got %v", name, index+1, arguments[index])
+}
+
+// phash returns the perceptual hash as 16 hex digits. Similar looking images
+// have hashes that differ in few bits.
+func phash(_ *lox.Interpreter, img *Image, _ []any) (v interface{}, err error) {
+	decoded, _, err := img.decode()
+	if err != nil {
+		return
+	}
+
+	return fmt.Sprintf("%016x", phashOf(decoded)), nil
+}
+
+// diff compares the image with another one, scaled to the same size. It
+// returns a dictionary with
+//   - similarity: the share of unchanged pixels, from 0 to 1
+//   - distance: how many of the 64 perceptual hash bits differ
+//   - image: the image faded to gray with changed pixels in red
+func diff(_ *lox.Interpreter, img *Image, arguments []any) (v interface{}, err error) {
+	other, err := imageArgument("diff", 0, arguments)
+	if err != nil {
+		return
+	}
+
+	base, _, err := img.decode()
+	if err != nil {
+		return
+	}
+
+	compared, _, err := other.decode()
+	if err != nil {
+		return
+	}
+
+	bounds := base.Bounds()
+	scaled := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.ApproxBiLinear.Scale(scaled, scaled.Bounds(), compared, compared.Bounds(), draw.Src, nil)
+
+	highlighted := image.NewRGBA(scaled.Bounds())
+	changed := 0
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			r1, g1, b1, _ := base.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			r2, g2, b2, _ := scaled.At(x, y).RGBA()
+
+			if channelDelta(r1, r2) > diffThreshold || channelDelta(g1, g2) > diffThreshold || channelDelta(b1, b2) > diffThreshold {
+				changed++
+				highlighted.Set(x, y, color.RGBA{R: 255, A: 255})
+				continue
+			}
+
+			// Luma, faded toward white so the red stands out.
+			gray := uint8((19595*r1 + 38470*g1 + 7471*b1 + 1<<15) >> 24)
+			gray = 255 - (255-gray)/3
+			highlighted.Set(x, y, color.RGBA{R: gray, G: gray, B: gray, A: 255})
+		}
+	}
+
+	derived, err := img.derive(highlighted, "png", defaultJpegQuality)
+	if err != nil {
+		return
+	}
+	derived.Name = "diff.png"
+
+	total := bounds.Dx() * bounds.Dy()
+	similarity := 1.0
+	if total > 0 {
+		similarity = 1 - float64(changed)/float64(total)
+	}
+
+	return lox.DictType{
+		"similarity": similarity,
+		"distance":   float64(bits.OnesCount64(phashOf(base) ^ phashOf(compared))),
+		"image":      NewImageInstance(derived),
+	}, nil
+}
+
+// channelDelta is the distance between two 16 bit color channels, scaled
+// to 0-255.
+func channelDelta(a uint32, b uint32) uint32 {
+	if a > b {
+		return (a - b) >> 8
+	}
+
+	return (b - a) >> 8
+}
+
+var _ lox.Callable = (*PreviousImageFunction)(nil)
+
+// PreviousImageFunction returns the image the last successful run of the
+// same function returned, or nil when there is none or the script runs
+// without History.
+type PreviousImageFunction struct {
+}
+
+func (f PreviousImageFunction) Call(i *lox.Interpreter, _ []interface{}) (v interface{}, err error) {
+	history := scriptOptions(i).History
+	if history == nil {
+		return nil, nil
+	}
+
+	img, err := history.PreviousImage(scriptContext(i))
+	if err != nil || img == nil {
+		return nil, err
+	}
+
+	return NewImageInstance(img), nil
+}
+
+func (f PreviousImageFunction) Arity() int {
+	return 0
+}
+
+func (f PreviousImageFunction) ToString() string {
+	return "<native fn previousImage>"
+}
+
+func (f PreviousImageFunction) Bind(instance *lox.LoxInstance) lox.Callable {
+	return f
+}
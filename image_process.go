@@ -0,0 +1,272 @@
+package bus_tracker
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/HugoSmits86/nativewebp"
+	lox "github.com/ariyn/lox_interpreter"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"path"
+	"strings"
+)
+
+const defaultJpegQuality = 90
+
+// maxImageSide bounds the width and height resize and thumbnail produce, so a
+// script can't allocate a canvas that exhausts memory. 8192x8192 RGBA is
+// 256MB.
+const maxImageSide = 8192
+
+var imageFormats = map[string]string{
+	"png":  "image/png",
+	"jpeg": "image/jpeg",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+}
+
+// decode parses the image body. The format is one of the imageFormats keys.
+func (img *Image) decode() (decoded image.Image, format string, err error) {
+	decoded, format, err = image.Decode(bytes.NewReader(img.Body))
+	if err != nil {
+		return nil, "", fmt.Errorf("could not decode %s: %v", img.Name, err)
+	}
+
+	return decoded, format, nil
+}
+
+// derive encodes decoded into a new Image that keeps img's source URL and
+// name, with the extension changed to match format. GIFs are re-encoded as
+// PNG, as only their first frame survives decoding anyway.
+func (img *Image) derive(decoded image.Image, format string, quality int) (*Image, error) {
+	var buf bytes.Buffer
+	var err error
+
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, decoded, &jpeg.Options{Quality: quality})
+	case "webp":
+		// Encoding is lossless, so quality has no effect.
+		err = nativewebp.Encode(&buf, decoded, nil)
+	default:
+		format = "png"
+		err = png.Encode(&buf, decoded)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not encode %s: %v", format, err)
+	}
+
+	name := strings.TrimSuffix(img.Name, path.Ext(img.Name)) + "." + format
+	if format == "jpeg" {
+		name = strings.TrimSuffix(name, ".jpeg") + ".jpg"
+	}
+
+	return &Image{
+		Url:         img.Url,
+		Name:        name,
+		ContentType: imageFormats[format],
+		Body:        buf.Bytes(),
+	}, nil
+}
+
+func scale(src image.Image, width int, height int) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+	return dst
+}
+
+func intArgument(name string, index int, arguments []any) (int, error) {
+	n, ok := arguments[index].(float64)
+	if !ok {
+		return 0, fmt.Errorf("%s() argument %d need number, but got %v", name, index+1, arguments[index])
+	}
+
+	return int(n), nil
+}
+
+func intArguments(name string, arguments []any) (values []int, err error) {
+	values = make([]int, len(arguments))
+	for i := range arguments {
+		values[i], err = intArgument(name, i, arguments)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return values, nil
+}
+
+// imageSize returns the width and height without decoding the pixels.
+func imageSize(img *Image) (width int, height int, err error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(img.Body))
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not decode %s: %v", img.Name, err)
+	}
+
+	return config.Width, config.Height, nil
+}
+
+func width(_ *lox.Interpreter, img *Image, _ []any) (v interface{}, err error) {
+	w, _, err := imageSize(img)
+	return float64(w), err
+}
+
+func height(_ *lox.Interpreter, img *Image, _ []any) (v interface{}, err error) {
+	_, h, err := imageSize(img)
+	return float64(h), err
+}
+
+// resize scales the image to width x height. When one of them is 0, it is
+// derived from the other, keeping the aspect ratio.
+func resize(_ *lox.Interpreter, img *Image, arguments []any) (v interface{}, err error) {
+	size, err := intArguments("resize", arguments)
+	if err != nil {
+		return
+	}
+
+	decoded, format, err := img.decode()
+	if err != nil {
+		return
+	}
+
+	w, h := size[0], size[1]
+	bounds := decoded.Bounds()
+	switch {
+	case w < 0 || h < 0 || (w == 0 && h == 0):
+		return nil, fmt.Errorf("resize() needs a positive size, but got %dx%d", w, h)
+	case w == 0:
+		w = max(bounds.Dx()*h/bounds.Dy(), 1)
+	case h == 0:
+		h = max(bounds.Dy()*w/bounds.Dx(), 1)
+	}
+
+	if w > maxImageSide || h > maxImageSide {
+		return nil, fmt.Errorf("resize() size can be up to %dx%d, but got %dx%d", maxImageSide, maxImageSide, w, h)
+	}
+
+	derived, err := img.derive(scale(decoded, w, h), format, defaultJpegQuality)
+	if err != nil {
+		return
+	}
+
+	return NewImageInstance(derived), nil
+}
+
+// crop cuts out the w x h region whose top left corner is at x, y. The region
+// is clipped to the image, but w and h must be positive.
+func crop(_ *lox.Interpreter, img *Image, arguments []any) (v interface{}, err error) {
+	rect, err := intArguments("crop", arguments)
+	if err != nil {
+		return
+	}
+
+	if rect[2] <= 0 || rect[3] <= 0 {
+		return nil, fmt.Errorf("crop() needs a positive size, but got %dx%d", rect[2], rect[3])
+	}
+
+	decoded, format, err := img.decode()
+	if err != nil {
+		return
+	}
+
+	bounds := decoded.Bounds()
+	region := image.Rect(rect[0], rect[1], rect[0]+rect[2], rect[1]+rect[3]).Add(bounds.Min).Intersect(bounds)
+	if region.Empty() {
+		return nil, fmt.Errorf("crop() region %v is outside of the %dx%d image", rect, bounds.Dx(), bounds.Dy())
+	}
+
+	cropped := image.NewRGBA(image.Rect(0, 0, region.Dx(), region.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), decoded, region.Min, draw.Src)
+
+	derived, err := img.derive(cropped, format, defaultJpegQuality)
+	if err != nil {
+		return
+	}
+
+	return NewImageInstance(derived), nil
+}
+
+// thumbnail shrinks the image to fit in a max x max square, keeping the
+// aspect ratio. Images that already fit are returned as they are.
+func thumbnail(_ *lox.Interpreter, img *Image, arguments []any) (v interface{}, err error) {
+	limit, err := intArgument("thumbnail", 0, arguments)
+	if err != nil {
+		return
+	}
+
+	if limit < 1 || limit > maxImageSide {
+		return nil, fmt.Errorf("thumbnail() size must be between 1 and %d, but got %d", maxImageSide, limit)
+	}
+
+	decoded, format, err := img.decode()
+	if err != nil {
+		return
+	}
+
+	bounds := decoded.Bounds()
+	if bounds.Dx() <= limit && bounds.Dy() <= limit {
+		return NewImageInstance(img), nil
+	}
+
+	w, h := limit, limit
+	if bounds.Dx() > bounds.Dy() {
+		h = max(bounds.Dy()*limit/bounds.Dx(), 1)
+	} else {
+		w = max(bounds.Dx()*limit/bounds.Dy(), 1)
+	}
+
+	derived, err := img.derive(scale(decoded, w, h), format, defaultJpegQuality)
+	if err != nil {
+		return
+	}
+
+	return NewImageInstance(derived), nil
+}
+
+// convert re-encodes the image as webp, jpeg or png. quality, from 1 to 100,
+// only applies to jpeg. webp and png are encoded losslessly, so they only take
+// a quality of 100, rather than silently ignoring a lower one.
+func convert(_ *lox.Interpreter, img *Image, arguments []any) (v interface{}, err error) {
+	format, ok := arguments[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("convert() 1st argument need string, but got %v", arguments[0])
+	}
+
+	format = strings.ToLower(format)
+	if format == "jpg" {
+		format = "jpeg"
+	}
+
+	if format != "webp" && format != "jpeg" && format != "png" {
+		return nil, fmt.Errorf("convert() format must be webp, jpeg or png, but got %s", format)
+	}
+
+	quality, err := intArgument("convert", 1, arguments)
+	if err != nil {
+		return
+	}
+
+	if quality < 1 || quality > 100 {
+		return nil, fmt.Errorf("convert() quality must be between 1 and 100, but got %d", quality)
+	}
+
+	if format != "jpeg" && quality != 100 {
+		return nil, fmt.Errorf("convert() encodes %s losslessly, so quality must be 100, but got %d", format, quality)
+	}
+
+	decoded, _, err := img.decode()
+	if err != nil {
+		return
+	}
+
+	derived, err := img.derive(decoded, format, quality)
+	if err != nil {
+		return
+	}
+
+	return NewImageInstance(derived), nil
+}
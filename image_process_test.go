@@ -0,0 +1,97 @@
+package bus_tracker
+
+import (
+	"bytes"
+	lox "github.com/ariyn/lox_interpreter"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func testImage(t *testing.T, width, height int) *Image {
+	t.Helper()
+
+	src := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			src.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Image{Url: "https://example.com/a.png", Name: "a.png", ContentType: "image/png", Body: buf.Bytes()}
+}
+
+func TestImageProcessing(t *testing.T) {
+	tests := []struct {
+		name        string
+		call        imageFunctionCall
+		arguments   []any
+		wantWidth   int
+		wantHeight  int
+		contentType string
+		fileName    string
+		wantErr     bool
+	}{
+		{"resize", resize, []any{20.0, 10.0}, 20, 10, "image/png", "a.png", false},
+		{"resize keeps ratio", resize, []any{0.0, 20.0}, 40, 20, "image/png", "a.png", false},
+		{"resize zero", resize, []any{0.0, 0.0}, 0, 0, "", "", true},
+		{"resize too large", resize, []any{maxImageSide + 1.0, 10.0}, 0, 0, "", "", true},
+		{"crop", crop, []any{10.0, 5.0, 20.0, 10.0}, 20, 10, "image/png", "a.png", false},
+		{"crop clipped", crop, []any{70.0, 30.0, 20.0, 20.0}, 10, 10, "image/png", "a.png", false},
+		{"crop outside", crop, []any{100.0, 100.0, 5.0, 5.0}, 0, 0, "", "", true},
+		{"crop negative width", crop, []any{10.0, 10.0, -5.0, 5.0}, 0, 0, "", "", true},
+		{"crop zero height", crop, []any{10.0, 10.0, 5.0, 0.0}, 0, 0, "", "", true},
+		{"thumbnail", thumbnail, []any{16.0}, 16, 8, "image/png", "a.png", false},
+		{"thumbnail that fits", thumbnail, []any{100.0}, 80, 40, "image/png", "a.png", false},
+		{"thumbnail zero", thumbnail, []any{0.0}, 0, 0, "", "", true},
+		{"convert jpeg", convert, []any{"jpg", 40.0}, 80, 40, "image/jpeg", "a.jpg", false},
+		{"convert webp", convert, []any{"webp", 100.0}, 80, 40, "image/webp", "a.webp", false},
+		{"convert webp with quality", convert, []any{"webp", 40.0}, 0, 0, "", "", true},
+		{"convert png with quality", convert, []any{"png", 40.0}, 0, 0, "", "", true},
+		{"convert unknown format", convert, []any{"bmp", 100.0}, 0, 0, "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := tt.call(nil, testImage(t, 80, 40), tt.arguments)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			instance, ok := v.(*lox.LoxInstance)
+			if !ok {
+				t.Fatalf("got %T, want an Image instance", v)
+			}
+			got, err := instance.Get(lox.Token{Lexeme: "_image"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			img := got.(*Image)
+
+			if img.ContentType != tt.contentType || img.Name != tt.fileName {
+				t.Errorf("got %s %s, want %s %s", img.Name, img.ContentType, tt.fileName, tt.contentType)
+			}
+
+			w, err := width(nil, img, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, err := height(nil, img, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w != float64(tt.wantWidth) || h != float64(tt.wantHeight) {
+				t.Errorf("size = %vx%v, want %dx%d", w, h, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
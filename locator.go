@@ -1,14 +1,16 @@
 package bus_tracker
 
 import (
+	"context"
 	"fmt"
+	"github.com/ariyn/bus-tracker/functions"
 	lox "github.com/ariyn/lox_interpreter"
 	"github.com/playwright-community/playwright-go"
 )
 
 const locatorKey = "_Locator"
 
-type locatorFunctionCall func(locator playwright.Locator, page playwright.Page, arguments []any) (v interface{}, err error)
+type locatorFunctionCall func(ctx context.Context, locator playwright.Locator, page playwright.Page, arguments []any) (v interface{}, err error)
 
 var _ lox.Callable = (*LocatorFunction)(nil)
 
@@ -48,7 +50,12 @@ func (f LocatorFunction) Call(i *lox.Interpreter, arguments []interface{}) (v in
 		return nil, fmt.Errorf("is not Page")
 	}
 
-	v, err = f.call(locator.(playwright.Locator), page.(playwright.Page), arguments)
+	ctx := scriptContext(i)
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	v, err = f.call(ctx, locator.(playwright.Locator), page.(playwright.Page), arguments)
 
 	return v, err
 }
@@ -69,10 +76,10 @@ func (f LocatorFunction) Bind(instance *lox.LoxInstance) lox.Callable {
 func NewLocatorInstance(_locator playwright.Locator, _page playwright.Page) (*lox.LoxInstance, error) {
 	instance := lox.NewLoxInstance(lox.NewLoxClass("Locator", nil, map[string]lox.Callable{
 		"locator": newLocatorFunction("locator", 1, locator),
-		"text": newLocatorFunction("text", 0, func(locator playwright.Locator, page playwright.Page, _ []interface{}) (v interface{}, err error) {
+		"text": newLocatorFunction("text", 0, func(ctx context.Context, locator playwright.Locator, page playwright.Page, _ []interface{}) (v interface{}, err error) {
 			return locator.TextContent()
 		}),
-		"click": newLocatorFunction("click", 0, func(locator playwright.Locator, page playwright.Page, _ []interface{}) (v interface{}, err error) {
+		"click": newLocatorFunction("click", 0, func(ctx context.Context, locator playwright.Locator, page playwright.Page, _ []interface{}) (v interface{}, err error) {
 			_ = locator.ScrollIntoViewIfNeeded()
 			mouse := page.Mouse()
 
@@ -84,13 +91,29 @@ func NewLocatorInstance(_locator playwright.Locator, _page playwright.Page) (*lo
 			_ = mouse.Move(box.X+box.Width/2, box.Y+box.Height/2)
 			return nil, mouse.Click(box.X+box.Width/2, box.Y+box.Height/2)
 		}),
-		"first": newLocatorFunction("first", 0, func(locator playwright.Locator, page playwright.Page, _ []interface{}) (v interface{}, err error) {
+		// html renders every element the locator matches, as it is in the
+		// DOM now, into CrawlData.
+		"html": newLocatorFunction("html", 0, func(ctx context.Context, locator playwright.Locator, page playwright.Page, _ []interface{}) (v interface{}, err error) {
+			html, err := locator.EvaluateAll("elements => elements.map(element => element.outerHTML).join('')")
+			if err != nil {
+				return nil, fmt.Errorf("could not get html: %v", err)
+			}
+
+			s, ok := html.(string)
+			if !ok {
+				return nil, fmt.Errorf("could not get html: got %v", html)
+			}
+
+			return functions.NewCrawlDataInstance(s)
+		}),
+		"screenshot": newLocatorFunction("screenshot", 0, locatorScreenshot),
+		"first": newLocatorFunction("first", 0, func(ctx context.Context, locator playwright.Locator, page playwright.Page, _ []interface{}) (v interface{}, err error) {
 			return NewLocatorInstance(locator.First(), page)
 		}),
-		"last": newLocatorFunction("last", 0, func(locator playwright.Locator, page playwright.Page, _ []interface{}) (v interface{}, err error) {
+		"last": newLocatorFunction("last", 0, func(ctx context.Context, locator playwright.Locator, page playwright.Page, _ []interface{}) (v interface{}, err error) {
 			return NewLocatorInstance(locator.Last(), page)
 		}),
-		"all": newLocatorFunction("all", 0, func(locator playwright.Locator, page playwright.Page, _ []interface{}) (v interface{}, err error) {
+		"all": newLocatorFunction("all", 0, func(ctx context.Context, locator playwright.Locator, page playwright.Page, _ []interface{}) (v interface{}, err error) {
 			all, err := locator.All()
 			if err != nil {
 				return nil, err
@@ -114,7 +137,7 @@ func NewLocatorInstance(_locator playwright.Locator, _page playwright.Page) (*lo
 	return instance, nil
 }
 
-func locator(locator playwright.Locator, page playwright.Page, arguments []any) (v interface{}, err error) {
+func locator(ctx context.Context, locator playwright.Locator, page playwright.Page, arguments []any) (v interface{}, err error) {
 	selector, ok := arguments[0].(string)
 	if !ok {
 		err = fmt.Errorf("get() 1st argument need string, but got %v", arguments[0])
@@ -0,0 +1,7 @@
+DROP TRIGGER IF EXISTS tasks_inserted ON tasks;
+DROP FUNCTION IF EXISTS notify_task_inserted();
+DROP TABLE IF EXISTS task_attempts;
+DROP TABLE IF EXISTS tasks;
+DROP TABLE IF EXISTS crontabs;
+DROP TABLE IF EXISTS environments;
+DROP TABLE IF EXISTS functions;
@@ -0,0 +1,76 @@
+CREATE TABLE functions (
+    id                    uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id               uuid,
+    name                  text        NOT NULL,
+    code                  text        NOT NULL,
+    max_attempts          integer     NOT NULL DEFAULT 1 CHECK (max_attempts >= 1),
+    retry_backoff_seconds integer     NOT NULL DEFAULT 30 CHECK (retry_backoff_seconds >= 0),
+    created_at            timestamptz NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE environments (
+    function_id uuid NOT NULL REFERENCES functions (id) ON DELETE CASCADE,
+    key         text NOT NULL,
+    value       text NOT NULL,
+    PRIMARY KEY (function_id, key)
+);
+
+CREATE TABLE crontabs (
+    id          uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    function_id uuid        NOT NULL REFERENCES functions (id) ON DELETE CASCADE,
+    user_id     uuid,
+    crontab     jsonb       NOT NULL,
+    next_run_at timestamptz NOT NULL DEFAULT NOW(),
+    created_at  timestamptz NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX crontabs_next_run_at_idx ON crontabs (next_run_at);
+
+CREATE TABLE tasks (
+    id           uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    function_id  uuid        NOT NULL REFERENCES functions (id) ON DELETE CASCADE,
+    user_id      uuid,
+    cron_id      uuid REFERENCES crontabs (id) ON DELETE SET NULL,
+    status       text        NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'running', 'succeeded', 'failed', 'retrying', 'cancelled', 'dead')),
+    priority     integer     NOT NULL DEFAULT 0,
+    attempts     integer     NOT NULL DEFAULT 0,
+    worker_id    text,
+    result       text,
+    error        text,
+    run_after    timestamptz,
+    heartbeat_at timestamptz,
+    started_at   timestamptz,
+    done_at      timestamptz,
+    created_at   timestamptz NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX tasks_claim_idx ON tasks (priority DESC, created_at)
+    WHERE done_at IS NULL AND status IN ('pending', 'retrying');
+CREATE INDEX tasks_heartbeat_idx ON tasks (heartbeat_at) WHERE status = 'running';
+CREATE INDEX tasks_function_id_idx ON tasks (function_id, created_at DESC);
+
+CREATE TABLE task_attempts (
+    task_id     uuid        NOT NULL REFERENCES tasks (id) ON DELETE CASCADE,
+    attempt     integer     NOT NULL,
+    worker_id   text,
+    status      text        NOT NULL CHECK (status IN ('succeeded', 'failed')),
+    error       text,
+    started_at  timestamptz,
+    finished_at timestamptz NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (task_id, attempt)
+);
+
+-- Wakes up workers listening on tasks_inserted as soon as a task is queued.
+CREATE FUNCTION notify_task_inserted() RETURNS trigger AS
+$$
+BEGIN
+    PERFORM pg_notify('tasks_inserted', NEW.id::text);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER tasks_inserted
+    AFTER INSERT ON tasks
+    FOR EACH ROW
+EXECUTE FUNCTION notify_task_inserted();
@@ -0,0 +1,2 @@
+ALTER TABLE tasks DROP COLUMN IF EXISTS scheduled_at;
+ALTER TABLE crontabs DROP COLUMN IF EXISTS scheduled_at;
@@ -0,0 +1,6 @@
+-- scheduled_at is the schedule time of the next fire, next_run_at the same
+-- time with the crontab's jitter added.
+ALTER TABLE crontabs ADD COLUMN scheduled_at timestamptz;
+UPDATE crontabs SET scheduled_at = next_run_at;
+
+ALTER TABLE tasks ADD COLUMN scheduled_at timestamptz;
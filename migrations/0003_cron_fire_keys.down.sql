@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS tasks_cron_fire_key;
+
+DROP INDEX IF EXISTS crontabs_next_run_at_idx;
+CREATE INDEX crontabs_next_run_at_idx ON crontabs (next_run_at);
+
+ALTER TABLE crontabs DROP COLUMN IF EXISTS last_error;
+ALTER TABLE crontabs DROP COLUMN IF EXISTS enabled;
@@ -0,0 +1,9 @@
+ALTER TABLE crontabs ADD COLUMN enabled boolean NOT NULL DEFAULT TRUE;
+ALTER TABLE crontabs ADD COLUMN last_error text;
+
+DROP INDEX IF EXISTS crontabs_next_run_at_idx;
+CREATE INDEX crontabs_next_run_at_idx ON crontabs (next_run_at) WHERE enabled;
+
+-- A crontab fires at most one task per schedule time, however often the
+-- firing is replayed.
+CREATE UNIQUE INDEX tasks_cron_fire_key ON tasks (cron_id, scheduled_at) WHERE cron_id IS NOT NULL;
@@ -0,0 +1,8 @@
+-- Browser storage states, encrypted by the worker before they are stored.
+CREATE TABLE browser_states (
+    function_id uuid        NOT NULL REFERENCES functions (id) ON DELETE CASCADE,
+    key         text        NOT NULL,
+    state       bytea       NOT NULL,
+    updated_at  timestamptz NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (function_id, key)
+);
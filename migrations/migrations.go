@@ -0,0 +1,222 @@
+package migrations
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+var filenameRegexp = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int
+	Name    string
+	up      string
+	down    string
+}
+
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Load reads the embedded migrations, ordered by version. Every migration
+// needs both an up and a down file.
+func Load() (migrations []Migration, err error) {
+	entries, err := fs.ReadDir(files, ".")
+	if err != nil {
+		return
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		matches := filenameRegexp.FindStringSubmatch(entry.Name())
+		if matches == nil {
+			return nil, fmt.Errorf("invalid migration filename %s", entry.Name())
+		}
+
+		version, _ := strconv.Atoi(matches[1])
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: matches[2]}
+			byVersion[version] = m
+		}
+
+		if m.Name != matches[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, matches[2])
+		}
+
+		b, err := files.ReadFile(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		if matches[3] == "up" {
+			m.up = string(b)
+		} else {
+			m.down = string(b)
+		}
+	}
+
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both up and down files", m.Version, m.Name)
+		}
+
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+func ensureTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    integer PRIMARY KEY,
+	name       text        NOT NULL,
+	applied_at timestamptz NOT NULL DEFAULT NOW()
+)`)
+	return err
+}
+
+func applied(db *sql.DB) (versions map[int]time.Time, err error) {
+	err = ensureTable(db)
+	if err != nil {
+		return
+	}
+
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	versions = make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		versions[version] = appliedAt
+	}
+
+	return versions, rows.Err()
+}
+
+// Up applies every migration that is not applied yet, each in its own
+// transaction, and returns the ones it applied.
+func Up(db *sql.DB) (done []Migration, err error) {
+	migrations, err := Load()
+	if err != nil {
+		return
+	}
+
+	versions, err := applied(db)
+	if err != nil {
+		return
+	}
+
+	for _, m := range migrations {
+		if _, ok := versions[m.Version]; ok {
+			continue
+		}
+
+		err = run(db, m.up, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name)
+		if err != nil {
+			return done, fmt.Errorf("migration %04d_%s: %v", m.Version, m.Name, err)
+		}
+
+		done = append(done, m)
+	}
+
+	return done, nil
+}
+
+// Down reverts the last steps applied migrations, newest first, and returns
+// the ones it reverted.
+func Down(db *sql.DB, steps int) (done []Migration, err error) {
+	migrations, err := Load()
+	if err != nil {
+		return
+	}
+
+	versions, err := applied(db)
+	if err != nil {
+		return
+	}
+
+	for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		m := migrations[i]
+		if _, ok := versions[m.Version]; !ok {
+			continue
+		}
+
+		err = run(db, m.down, "DELETE FROM schema_migrations WHERE version = $1", m.Version)
+		if err != nil {
+			return done, fmt.Errorf("migration %04d_%s: %v", m.Version, m.Name, err)
+		}
+
+		done = append(done, m)
+	}
+
+	return done, nil
+}
+
+// Statuses lists every embedded migration with the time it was applied, if
+// it was.
+func Statuses(db *sql.DB) (statuses []Status, err error) {
+	migrations, err := Load()
+	if err != nil {
+		return
+	}
+
+	versions, err := applied(db)
+	if err != nil {
+		return
+	}
+
+	for _, m := range migrations {
+		status := Status{Migration: m}
+		if appliedAt, ok := versions[m.Version]; ok {
+			status.AppliedAt = &appliedAt
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+func run(db *sql.DB, script string, record string, args ...interface{}) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(script)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(record, args...)
+	if err != nil {
+		return
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,88 @@
+package bus_tracker
+
+import (
+	"fmt"
+	lox "github.com/ariyn/lox_interpreter"
+)
+
+// optionsArgument reads the dictionary a native takes as its options,
+// e.g. screenshotWith({fullPage: false}). Every key must be in known, so
+// typos fail loudly instead of being ignored.
+func optionsArgument(name string, index int, arguments []any, known ...string) (options lox.DictType, err error) {
+	options, ok := arguments[index].(lox.DictType)
+	if !ok {
+		return nil, fmt.Errorf("%s() argument %d need dictionary, but got %v", name, index+1, arguments[index])
+	}
+
+	for key := range options {
+		isKnown := false
+		for _, k := range known {
+			if key == k {
+				isKnown = true
+				break
+			}
+		}
+
+		if !isKnown {
+			return nil, fmt.Errorf("%s() got unknown option %s", name, key)
+		}
+	}
+
+	return options, nil
+}
+
+func stringOption(name string, options lox.DictType, key string) (v *string, err error) {
+	value, ok := options[key]
+	if !ok || value == nil {
+		return nil, nil
+	}
+
+	s, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s() option %s need string, but got %v", name, key, value)
+	}
+
+	return &s, nil
+}
+
+func numberOption(name string, options lox.DictType, key string) (v *float64, err error) {
+	value, ok := options[key]
+	if !ok || value == nil {
+		return nil, nil
+	}
+
+	n, ok := value.(float64)
+	if !ok {
+		return nil, fmt.Errorf("%s() option %s need number, but got %v", name, key, value)
+	}
+
+	return &n, nil
+}
+
+func boolOption(name string, options lox.DictType, key string) (v *bool, err error) {
+	value, ok := options[key]
+	if !ok || value == nil {
+		return nil, nil
+	}
+
+	b, ok := value.(bool)
+	if !ok {
+		return nil, fmt.Errorf("%s() option %s need boolean, but got %v", name, key, value)
+	}
+
+	return &b, nil
+}
+
+func dictOption(name string, options lox.DictType, key string) (v lox.DictType, err error) {
+	value, ok := options[key]
+	if !ok || value == nil {
+		return nil, nil
+	}
+
+	dict, ok := value.(lox.DictType)
+	if !ok {
+		return nil, fmt.Errorf("%s() option %s need dictionary, but got %v", name, key, value)
+	}
+
+	return dict, nil
+}
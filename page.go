@@ -3,15 +3,24 @@ package bus_tracker
 import (
 	"context"
 	"fmt"
+	"github.com/ariyn/bus-tracker/functions"
 	lox "github.com/ariyn/lox_interpreter"
 	"github.com/playwright-community/playwright-go"
 	"time"
 )
 
+// NewPageInstance wraps page. It starts recording the page's XHR and fetch
+// responses, so it should be called before the page navigates.
 func NewPageInstance(page playwright.Page) (*lox.LoxInstance, error) {
+	return newPageInstance(page, pageState{})
+}
+
+func newPageInstance(page playwright.Page, state pageState) (*lox.LoxInstance, error) {
+	responses := recordResponses(page)
+
 	instance := lox.NewLoxInstance(
 		lox.NewLoxClass("Page", nil, map[string]lox.Callable{
-			"locator": newFunction("locator", 1, func(page playwright.Page, arguments []any) (v interface{}, err error) {
+			"locator": newFunction("locator", 1, func(ctx context.Context, page playwright.Page, arguments []any) (v interface{}, err error) {
 				selector, ok := arguments[0].(string)
 				if !ok {
 					err = fmt.Errorf("get() 1st argument need string, but got %v", arguments[0])
@@ -20,23 +29,32 @@ func NewPageInstance(page playwright.Page) (*lox.LoxInstance, error) {
 
 				return NewLocatorInstance(page.Locator(selector), page)
 			}),
-			"screenshot": newFunction("image", 0, func(page playwright.Page, arguments []any) (v interface{}, err error) {
-				image, err := page.Screenshot(playwright.PageScreenshotOptions{
-					FullPage: playwright.Bool(true),
-				})
-
+			"screenshot":       newFunction("screenshot", 0, screenshot),
+			"screenshotWith":   newFunction("screenshotWith", 1, screenshotWith),
+			"pdf":              newFunction("pdf", 0, pdf),
+			"goto":             newFunction("goto", 1, gotoUrl),
+			"waitForSelector":  newFunction("waitForSelector", 2, waitForSelector),
+			"waitForLoadState": newFunction("waitForLoadState", 1, waitForLoadState),
+			"fill":             newFunction("fill", 2, fill),
+			"type":             newFunction("type", 2, typeText),
+			"press":            newFunction("press", 2, press),
+			"selectOption":     newFunction("selectOption", 2, selectOption),
+			"scroll":           newFunction("scroll", 2, scroll),
+			"evaluate":         newFunction("evaluate", 1, evaluate),
+			"url":              newFunction("url", 0, pageUrl),
+			"title":            newFunction("title", 0, title),
+			"waitForResponse":  newFunction("waitForResponse", 1, responses.waitForResponse),
+			"responses":        newFunction("responses", 1, responses.responses),
+			"saveState":        newFunction("saveState", 0, state.saveState),
+			"content": newFunction("content", 0, func(ctx context.Context, page playwright.Page, arguments []any) (v interface{}, err error) {
+				html, err := page.Content()
 				if err != nil {
-					return nil, fmt.Errorf("could not take screenshot: %v", err)
+					return nil, fmt.Errorf("could not get content: %v", err)
 				}
 
-				return NewImageInstance(&Image{
-					Url:         "",
-					Body:        image,
-					Name:        "screenshot.png",
-					ContentType: "image/png",
-				}), nil
+				return functions.NewCrawlDataInstance(html)
 			}),
-			"frameLocator": newFunction("frameLocator", 1, func(page playwright.Page, arguments []any) (v interface{}, err error) {
+			"frameLocator": newFunction("frameLocator", 1, func(ctx context.Context, page playwright.Page, arguments []any) (v interface{}, err error) {
 				selector, ok := arguments[0].(string)
 				if !ok {
 					err = fmt.Errorf("get() 1st argument need string, but got %v", arguments[0])
@@ -45,24 +63,24 @@ func NewPageInstance(page playwright.Page) (*lox.LoxInstance, error) {
 
 				return NewLocatorInstance(page.FrameLocator(selector).Owner(), page)
 			}),
-			"_sleep": newFunction("_sleep", 1, func(page playwright.Page, arguments []any) (v interface{}, err error) {
+			"_sleep": newFunction("_sleep", 1, func(ctx context.Context, page playwright.Page, arguments []any) (v interface{}, err error) {
 				seconds, ok := arguments[0].(float64)
 				if !ok {
 					err = fmt.Errorf("_sleep() 1st argument need number, but got %v", arguments[0])
 					return
 				}
 
-				waitCtx, cancel := context.WithCancel(context.Background())
+				waitCtx, cancel := context.WithCancel(ctx)
 				defer cancel()
 
 				move := moveMouseRandom(waitCtx, page)
 				go move()
 
-				<-time.After(time.Duration(seconds) * time.Second)
+				err = sleepContext(ctx, time.Duration(seconds*float64(time.Second)))
 
 				cancel()
 
-				return nil, nil
+				return nil, err
 			}),
 		}))
 
@@ -71,7 +89,7 @@ func NewPageInstance(page playwright.Page) (*lox.LoxInstance, error) {
 	return instance, nil
 }
 
-type pageFunctionCall func(doc playwright.Page, arguments []any) (v interface{}, err error)
+type pageFunctionCall func(ctx context.Context, doc playwright.Page, arguments []any) (v interface{}, err error)
 
 var _ lox.Callable = (*PageFunction)(nil)
 
@@ -101,7 +119,12 @@ func (f PageFunction) Call(i *lox.Interpreter, arguments []interface{}) (v inter
 		return nil, fmt.Errorf("is not Document")
 	}
 
-	v, err = f.call(page.(playwright.Page), arguments)
+	ctx := scriptContext(i)
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	v, err = f.call(ctx, page.(playwright.Page), arguments)
 
 	return v, err
 }
@@ -0,0 +1,254 @@
+package bus_tracker
+
+import (
+	"context"
+	"fmt"
+	lox "github.com/ariyn/lox_interpreter"
+	"github.com/playwright-community/playwright-go"
+)
+
+func stringArgument(name string, index int, arguments []any) (string, error) {
+	s, ok := arguments[index].(string)
+	if !ok {
+		return "", fmt.Errorf("%s() argument %d need string, but got %v", name, index+1, arguments[index])
+	}
+
+	return s, nil
+}
+
+// stringArguments reads arguments that all need to be strings, like the
+// selector and value of the input natives.
+func stringArguments(name string, arguments []any) (values []string, err error) {
+	values = make([]string, len(arguments))
+	for i := range arguments {
+		values[i], err = stringArgument(name, i, arguments)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return values, nil
+}
+
+// waitTimeout is the shorter of seconds and the time the script has left, in
+// the milliseconds playwright expects. seconds must be positive, as playwright
+// reads a timeout of 0 as waiting forever.
+func waitTimeout(ctx context.Context, name string, seconds float64) (*float64, error) {
+	if seconds <= 0 {
+		return nil, fmt.Errorf("%s() timeout must be positive, but got %v", name, seconds)
+	}
+
+	timeout := playwright.Float(max(seconds*1000, 1))
+	if remaining := playwrightTimeout(ctx); remaining != nil && *remaining < *timeout {
+		return remaining, nil
+	}
+
+	return timeout, nil
+}
+
+// gotoUrl navigates the page to url and waits for the DOM to be loaded, like
+// browser() does for the first page.
+func gotoUrl(ctx context.Context, page playwright.Page, arguments []any) (v interface{}, err error) {
+	url, err := stringArgument("goto", 0, arguments)
+	if err != nil {
+		return
+	}
+
+	_, err = page.Goto(url, playwright.PageGotoOptions{
+		WaitUntil: playwright.WaitUntilStateDomcontentloaded,
+		Timeout:   playwrightTimeout(ctx),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not goto: %v", err)
+	}
+
+	return nil, nil
+}
+
+// waitForSelector waits up to timeout seconds for selector to be visible and
+// returns its Locator.
+func waitForSelector(ctx context.Context, page playwright.Page, arguments []any) (v interface{}, err error) {
+	selector, err := stringArgument("waitForSelector", 0, arguments)
+	if err != nil {
+		return
+	}
+
+	seconds, ok := arguments[1].(float64)
+	if !ok {
+		return nil, fmt.Errorf("waitForSelector() argument 2 need number, but got %v", arguments[1])
+	}
+
+	timeout, err := waitTimeout(ctx, "waitForSelector", seconds)
+	if err != nil {
+		return
+	}
+
+	locator := page.Locator(selector).First()
+	err = locator.WaitFor(playwright.LocatorWaitForOptions{
+		State:   playwright.WaitForSelectorStateVisible,
+		Timeout: timeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not wait for %s: %v", selector, err)
+	}
+
+	return NewLocatorInstance(locator, page)
+}
+
+var loadStates = map[string]*playwright.LoadState{
+	"load":             playwright.LoadStateLoad,
+	"domcontentloaded": playwright.LoadStateDomcontentloaded,
+	"networkidle":      playwright.LoadStateNetworkidle,
+}
+
+// waitForLoadState waits for load, domcontentloaded or networkidle.
+func waitForLoadState(ctx context.Context, page playwright.Page, arguments []any) (v interface{}, err error) {
+	state, err := stringArgument("waitForLoadState", 0, arguments)
+	if err != nil {
+		return
+	}
+
+	loadState, ok := loadStates[state]
+	if !ok {
+		return nil, fmt.Errorf("waitForLoadState() state must be load, domcontentloaded or networkidle, but got %s", state)
+	}
+
+	err = page.WaitForLoadState(playwright.PageWaitForLoadStateOptions{
+		State:   loadState,
+		Timeout: playwrightTimeout(ctx),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not wait for load state: %v", err)
+	}
+
+	return nil, nil
+}
+
+// fill replaces the value of the input matching selector at once.
+func fill(ctx context.Context, page playwright.Page, arguments []any) (v interface{}, err error) {
+	values, err := stringArguments("fill", arguments)
+	if err != nil {
+		return
+	}
+
+	return nil, page.Locator(values[0]).First().Fill(values[1], playwright.LocatorFillOptions{
+		Timeout: playwrightTimeout(ctx),
+	})
+}
+
+// typeText types text into the input matching selector key by key, for
+// pages that react to every keystroke.
+func typeText(ctx context.Context, page playwright.Page, arguments []any) (v interface{}, err error) {
+	values, err := stringArguments("type", arguments)
+	if err != nil {
+		return
+	}
+
+	return nil, page.Locator(values[0]).First().PressSequentially(values[1], playwright.LocatorPressSequentiallyOptions{
+		Delay:   playwright.Float(50),
+		Timeout: playwrightTimeout(ctx),
+	})
+}
+
+// press presses a key, e.g. Enter or Control+A, on the element matching
+// selector.
+func press(ctx context.Context, page playwright.Page, arguments []any) (v interface{}, err error) {
+	values, err := stringArguments("press", arguments)
+	if err != nil {
+		return
+	}
+
+	return nil, page.Locator(values[0]).First().Press(values[1], playwright.LocatorPressOptions{
+		Timeout: playwrightTimeout(ctx),
+	})
+}
+
+// selectOption selects options of the select matching selector by value or
+// label. It takes one string or a list of them, and returns the selected
+// values.
+func selectOption(ctx context.Context, page playwright.Page, arguments []any) (v interface{}, err error) {
+	selector, err := stringArgument("selectOption", 0, arguments)
+	if err != nil {
+		return
+	}
+
+	var options []string
+	switch value := arguments[1].(type) {
+	case string:
+		options = []string{value}
+	case lox.ListType:
+		for _, item := range value {
+			option, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("selectOption() argument 2 need strings, but got %v", item)
+			}
+			options = append(options, option)
+		}
+	default:
+		return nil, fmt.Errorf("selectOption() argument 2 need string or list, but got %v", arguments[1])
+	}
+
+	selected, err := page.Locator(selector).First().SelectOption(playwright.SelectOptionValues{
+		ValuesOrLabels: &options,
+	}, playwright.LocatorSelectOptionOptions{
+		Timeout: playwrightTimeout(ctx),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not select %v: %v", options, err)
+	}
+
+	list := make(lox.ListType, len(selected))
+	for i, value := range selected {
+		list[i] = value
+	}
+
+	return list, nil
+}
+
+// scroll scrolls the page by x and y pixels with the mouse wheel, so
+// infinite-scroll pages load their next items. The wheel has no timeout
+// option, so the page is closed when ctx is done.
+func scroll(ctx context.Context, page playwright.Page, arguments []any) (v interface{}, err error) {
+	x, ok := arguments[0].(float64)
+	if !ok {
+		return nil, fmt.Errorf("scroll() argument 1 need number, but got %v", arguments[0])
+	}
+
+	y, ok := arguments[1].(float64)
+	if !ok {
+		return nil, fmt.Errorf("scroll() argument 2 need number, but got %v", arguments[1])
+	}
+
+	return nil, untilDone(ctx, page, func() error {
+		return page.Mouse().Wheel(x, y)
+	})
+}
+
+// evaluate runs js in the page and returns its result as Lox values. js is
+// an expression, or a function that is called without arguments. Like scroll,
+// it closes the page when ctx is done before js returns.
+func evaluate(ctx context.Context, page playwright.Page, arguments []any) (v interface{}, err error) {
+	js, err := stringArgument("evaluate", 0, arguments)
+	if err != nil {
+		return
+	}
+
+	var result interface{}
+	err = untilDone(ctx, page, func() (err error) {
+		result, err = page.Evaluate(js)
+		return
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not evaluate: %v", err)
+	}
+
+	return toLoxValue(result)
+}
+
+func pageUrl(_ context.Context, page playwright.Page, _ []any) (v interface{}, err error) {
+	return page.URL(), nil
+}
+
+func title(_ context.Context, page playwright.Page, _ []any) (v interface{}, err error) {
+	return page.Title()
+}
@@ -0,0 +1,374 @@
+package bus_tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/playwright-community/playwright-go"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrBrowserPoolClosed = errors.New("browser pool is closed")
+var ErrBrowserLeaseReleased = errors.New("browser lease is released")
+
+// Browsers is the pool browser() leases from. It is set up by the commands
+// before any script runs.
+var Browsers *BrowserPool
+
+type BrowserPoolOptions struct {
+	// MaxBrowsers is the number of browsers that can be leased at once.
+	MaxBrowsers int
+	// MaxUses is the number of leases after which a browser is closed and
+	// replaced. Zero means browsers are never recycled.
+	MaxUses int
+	// HealthCheckInterval is how often idle browsers are checked for a live
+	// connection.
+	HealthCheckInterval time.Duration
+	// BrowserType is firefox or chromium. Only chromium can print PDFs.
+	BrowserType string
+}
+
+// BrowserPoolOptionsFromEnv reads BROWSER_POOL_SIZE, BROWSER_MAX_USES,
+// BROWSER_HEALTH_CHECK_INTERVAL and BROWSER_TYPE, falling back to defaults for
+// unset ones.
+func BrowserPoolOptionsFromEnv() (options BrowserPoolOptions, err error) {
+	options = BrowserPoolOptions{
+		MaxBrowsers:         2,
+		MaxUses:             50,
+		HealthCheckInterval: 30 * time.Second,
+		BrowserType:         "firefox",
+	}
+
+	if v := os.Getenv("BROWSER_POOL_SIZE"); v != "" {
+		options.MaxBrowsers, err = strconv.Atoi(v)
+		if err != nil {
+			return options, fmt.Errorf("invalid BROWSER_POOL_SIZE: %v", err)
+		}
+	}
+
+	if v := os.Getenv("BROWSER_MAX_USES"); v != "" {
+		options.MaxUses, err = strconv.Atoi(v)
+		if err != nil {
+			return options, fmt.Errorf("invalid BROWSER_MAX_USES: %v", err)
+		}
+	}
+
+	if v := os.Getenv("BROWSER_HEALTH_CHECK_INTERVAL"); v != "" {
+		options.HealthCheckInterval, err = time.ParseDuration(v)
+		if err != nil {
+			return options, fmt.Errorf("invalid BROWSER_HEALTH_CHECK_INTERVAL: %v", err)
+		}
+	}
+
+	if v := os.Getenv("BROWSER_TYPE"); v != "" {
+		options.BrowserType = strings.ToLower(v)
+	}
+
+	return options, nil
+}
+
+type pooledBrowser struct {
+	browser playwright.Browser
+	uses    int
+	// leases counts the leases open on the browser. It goes back to the pool
+	// when the last of them is released.
+	leases int
+	broken bool
+}
+
+// BrowserPool keeps a single playwright driver and a bounded set of browsers
+// alive between scripts. Each lease gets its own browser context, so
+// cookies and storage are never shared between scripts.
+type BrowserPool struct {
+	options BrowserPoolOptions
+	pw      *playwright.Playwright
+
+	slots chan struct{}
+	done  chan struct{}
+
+	mu     sync.Mutex
+	idle   []*pooledBrowser
+	leased map[*pooledBrowser]struct{}
+	closed bool
+}
+
+func NewBrowserPool(options BrowserPoolOptions) (*BrowserPool, error) {
+	if options.MaxBrowsers < 1 {
+		return nil, fmt.Errorf("browser pool needs at least 1 browser, but got %d", options.MaxBrowsers)
+	}
+
+	if options.BrowserType == "" {
+		options.BrowserType = "firefox"
+	}
+
+	if options.BrowserType != "firefox" && options.BrowserType != "chromium" {
+		return nil, fmt.Errorf("browser type must be firefox or chromium, but got %s", options.BrowserType)
+	}
+
+	pw, err := playwright.Run(&playwright.RunOptions{
+		SkipInstallBrowsers: false,
+		Stdout:              os.Stdout,
+		Stderr:              os.Stderr,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not start playwright: %v", err)
+	}
+
+	p := &BrowserPool{
+		options: options,
+		pw:      pw,
+		slots:   make(chan struct{}, options.MaxBrowsers),
+		done:    make(chan struct{}),
+		leased:  make(map[*pooledBrowser]struct{}),
+	}
+
+	if options.HealthCheckInterval > 0 {
+		go p.healthCheck()
+	}
+
+	return p, nil
+}
+
+// Acquire waits for a free browser and opens a new context on it.
+func (p *BrowserPool) Acquire(ctx context.Context, options playwright.BrowserNewContextOptions) (lease *BrowserLease, err error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	b, err := p.take()
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+
+	browserContext, err := b.browser.NewContext(options)
+	if err != nil {
+		b.leases = 0
+		p.put(b, true)
+		return nil, fmt.Errorf("could not create browser context: %v", err)
+	}
+
+	return &BrowserLease{
+		Context: browserContext,
+		pool:    p,
+		browser: b,
+	}, nil
+}
+
+func (p *BrowserPool) take() (b *pooledBrowser, err error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrBrowserPoolClosed
+	}
+
+	if n := len(p.idle); n > 0 {
+		b = p.idle[n-1]
+		p.idle = p.idle[:n-1]
+	}
+	p.mu.Unlock()
+
+	if b != nil && !b.browser.IsConnected() {
+		_ = b.browser.Close()
+		b = nil
+	}
+
+	if b == nil {
+		browserType := p.pw.Firefox
+		if p.options.BrowserType == "chromium" {
+			browserType = p.pw.Chromium
+		}
+
+		browser, err := browserType.Launch(playwright.BrowserTypeLaunchOptions{
+			Args: []string{"--incognito"},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not launch browser: %v", err)
+		}
+
+		b = &pooledBrowser{browser: browser}
+	}
+
+	b.uses++
+	b.leases = 1
+	b.broken = false
+
+	p.mu.Lock()
+	p.leased[b] = struct{}{}
+	p.mu.Unlock()
+
+	return b, nil
+}
+
+// put gives a browser back to the pool, closing it instead when it is
+// broken, worn out or the pool is closed.
+func (p *BrowserPool) put(b *pooledBrowser, broken bool) {
+	defer func() { <-p.slots }()
+
+	p.mu.Lock()
+	delete(p.leased, b)
+	recycle := broken || p.closed || !b.browser.IsConnected() ||
+		(p.options.MaxUses > 0 && b.uses >= p.options.MaxUses)
+	if !recycle {
+		p.idle = append(p.idle, b)
+	}
+	p.mu.Unlock()
+
+	if recycle {
+		err := b.browser.Close()
+		if err != nil {
+			log.Println("could not close browser", err)
+		}
+	}
+}
+
+func (p *BrowserPool) healthCheck() {
+	ticker := time.NewTicker(p.options.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		p.mu.Lock()
+		healthy := p.idle[:0]
+		var dead []*pooledBrowser
+		for _, b := range p.idle {
+			if b.browser.IsConnected() {
+				healthy = append(healthy, b)
+			} else {
+				dead = append(dead, b)
+			}
+		}
+		p.idle = healthy
+		p.mu.Unlock()
+
+		for _, b := range dead {
+			log.Println("dropping disconnected browser")
+			_ = b.browser.Close()
+		}
+	}
+}
+
+// Close stops handing out leases, waits for the leased browsers to come back,
+// then closes every browser and stops the playwright driver. When ctx is done
+// before every lease is released, the browsers still leased are closed under
+// their scripts.
+func (p *BrowserPool) Close(ctx context.Context) (err error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+	p.mu.Unlock()
+
+	var leased []*pooledBrowser
+wait:
+	for i := 0; i < cap(p.slots); i++ {
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			p.mu.Lock()
+			for b := range p.leased {
+				leased = append(leased, b)
+			}
+			p.mu.Unlock()
+			break wait
+		}
+	}
+
+	for _, b := range leased {
+		log.Println("closing a browser that is still leased")
+		err = errors.Join(err, b.browser.Close())
+	}
+
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	for _, b := range idle {
+		err = errors.Join(err, b.browser.Close())
+	}
+
+	return errors.Join(err, p.pw.Stop())
+}
+
+// BrowserLease is a browser context borrowed from a BrowserPool. Release must
+// be called once the context is no longer used.
+type BrowserLease struct {
+	Context playwright.BrowserContext
+
+	pool     *BrowserPool
+	browser  *pooledBrowser
+	release  sync.Once
+	closeErr error
+}
+
+// Share opens another context on the lease's browser without waiting for a
+// free one, so a script that opens a second page while the pool is full
+// doesn't wait on itself. The browser goes back to the pool once every lease
+// on it is released.
+func (l *BrowserLease) Share(options playwright.BrowserNewContextOptions) (lease *BrowserLease, err error) {
+	p := l.pool
+	b := l.browser
+
+	p.mu.Lock()
+	if b.leases == 0 {
+		p.mu.Unlock()
+		return nil, ErrBrowserLeaseReleased
+	}
+	b.leases++
+	p.mu.Unlock()
+
+	lease = &BrowserLease{
+		pool:    p,
+		browser: b,
+	}
+
+	lease.Context, err = b.browser.NewContext(options)
+	if err != nil {
+		lease.done(true)
+		return nil, fmt.Errorf("could not create browser context: %v", err)
+	}
+
+	return lease, nil
+}
+
+// Release closes the lease's context and, for the last lease on its
+// browser, returns the browser to the pool.
+func (l *BrowserLease) Release() error {
+	l.release.Do(func() {
+		l.closeErr = l.Context.Close()
+		l.done(l.closeErr != nil)
+	})
+
+	return l.closeErr
+}
+
+func (l *BrowserLease) done(broken bool) {
+	p := l.pool
+	b := l.browser
+
+	p.mu.Lock()
+	b.leases--
+	b.broken = b.broken || broken
+	last := b.leases == 0
+	p.mu.Unlock()
+
+	if last {
+		p.put(b, b.broken)
+	}
+}
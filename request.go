@@ -0,0 +1,434 @@
+package bus_tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	lox "github.com/ariyn/lox_interpreter"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpRequest is a request built by request() or get().
+type httpRequest struct {
+	method  string
+	url     string
+	headers http.Header
+	body    []byte
+	// timeout bounds the request on top of the script's own timeout. Zero
+	// means no extra bound.
+	timeout time.Duration
+	// allowErrors accepts responses outside of 2xx instead of failing.
+	allowErrors bool
+	// response returns the Response instead of its converted body.
+	response bool
+	// charset overrides the charset text bodies are decoded with.
+	charset string
+	// retry overrides fields of the script's retry policy.
+	retry lox.DictType
+}
+
+// parseRequest reads the options request() takes:
+//   - method: GET by default
+//   - url
+//   - headers: {name: value}
+//   - query: {name: value or list of values}, added to the url's own query
+//   - json: any value, sent as a JSON body
+//   - form: {name: value or list of values}, sent url encoded
+//   - body: a string sent as it is
+//   - timeout: seconds
+//   - response: true to get a Response with the status and headers instead
+//     of the converted body
+//   - allowErrors: true to accept statuses outside of 2xx
+//   - charset: the charset of the body, e.g. euc-kr, when the server does not
+//     declare it correctly
+//   - retry: {attempts, backoff, maxBackoff, jitter, statuses, retryAfter}
+//     to override the script's retry policy, durations in seconds
+//
+// Only one of json, form and body can be given.
+func parseRequest(name string, options lox.DictType) (r *httpRequest, err error) {
+	for key := range options {
+		switch key {
+		case "method", "url", "headers", "query", "json", "form", "body", "timeout", "response", "allowErrors", "charset", "retry":
+		default:
+			return nil, fmt.Errorf("%s() got unknown option %s", name, key)
+		}
+	}
+
+	r = &httpRequest{
+		method:  http.MethodGet,
+		headers: make(http.Header),
+	}
+
+	method, err := stringOption(name, options, "method")
+	if err != nil {
+		return
+	}
+	if method != nil {
+		r.method = strings.ToUpper(*method)
+	}
+
+	rawUrl, err := stringOption(name, options, "url")
+	if err != nil {
+		return
+	}
+	if rawUrl == nil {
+		return nil, fmt.Errorf("%s() needs a url", name)
+	}
+
+	u, err := absoluteUrl(name, *rawUrl)
+	if err != nil {
+		return
+	}
+
+	query, err := dictOption(name, options, "query")
+	if err != nil {
+		return
+	}
+	if query != nil {
+		values := u.Query()
+		err = addValues(name, "query", values, query)
+		if err != nil {
+			return
+		}
+		u.RawQuery = values.Encode()
+	}
+	r.url = u.String()
+
+	headers, err := dictOption(name, options, "headers")
+	if err != nil {
+		return
+	}
+	for k, v := range headers {
+		value, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s() header %s need string, but got %v", name, k, v)
+		}
+		r.headers.Set(k, value)
+	}
+
+	bodies := 0
+	for _, key := range []string{"json", "form", "body"} {
+		if v, ok := options[key]; ok && v != nil {
+			bodies++
+		}
+	}
+	if bodies > 1 {
+		return nil, fmt.Errorf("%s() takes only one of json, form and body", name)
+	}
+
+	if v, ok := options["json"]; ok && v != nil {
+		r.body, err = json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s() could not encode json: %v", name, err)
+		}
+		setDefaultHeader(r.headers, "Content-Type", "application/json")
+	}
+
+	form, err := dictOption(name, options, "form")
+	if err != nil {
+		return
+	}
+	if form != nil {
+		values := make(url.Values)
+		err = addValues(name, "form", values, form)
+		if err != nil {
+			return
+		}
+		r.body = []byte(values.Encode())
+		setDefaultHeader(r.headers, "Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	body, err := stringOption(name, options, "body")
+	if err != nil {
+		return
+	}
+	if body != nil {
+		r.body = []byte(*body)
+	}
+
+	timeout, err := numberOption(name, options, "timeout")
+	if err != nil {
+		return
+	}
+	if timeout != nil {
+		if *timeout <= 0 {
+			return nil, fmt.Errorf("%s() timeout must be positive, but got %v", name, *timeout)
+		}
+		r.timeout = time.Duration(*timeout * float64(time.Second))
+	}
+
+	charset, err := stringOption(name, options, "charset")
+	if err != nil {
+		return
+	}
+	if charset != nil {
+		r.charset = *charset
+	}
+
+	r.retry, err = dictOption(name, options, "retry")
+	if err != nil {
+		return
+	}
+	if r.retry != nil {
+		_, err = DefaultRetryPolicy().withOptions(name, r.retry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for key, flag := range map[string]*bool{"response": &r.response, "allowErrors": &r.allowErrors} {
+		b, err := boolOption(name, options, key)
+		if err != nil {
+			return nil, err
+		}
+		if b != nil {
+			*flag = *b
+		}
+	}
+
+	return r, nil
+}
+
+// absoluteUrl parses rawUrl, which must be absolute. Sessions resolve
+// relative urls against their base URL before they get here.
+func absoluteUrl(name string, rawUrl string) (*url.URL, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, fmt.Errorf("%s() invalid url %s: %v", name, rawUrl, err)
+	}
+
+	if !u.IsAbs() || u.Host == "" {
+		return nil, fmt.Errorf("%s() url must be absolute, but got %s", name, rawUrl)
+	}
+
+	return u, nil
+}
+
+func setDefaultHeader(headers http.Header, key string, value string) {
+	if headers.Get(key) == "" {
+		headers.Set(key, value)
+	}
+}
+
+// addValues adds a query or form dictionary to values. Keys are added in
+// order, so the same script always sends the same request.
+func addValues(name string, option string, values url.Values, dict lox.DictType) error {
+	keys := make([]string, 0, len(dict))
+	for k := range dict {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		items, isList := dict[k].(lox.ListType)
+		if !isList {
+			items = lox.ListType{dict[k]}
+		}
+
+		for _, item := range items {
+			s, err := formatValue(item)
+			if err != nil {
+				return fmt.Errorf("%s() %s %s: %v", name, option, k, err)
+			}
+			values.Add(k, s)
+		}
+	}
+
+	return nil
+}
+
+// redactUrl hides the query values and password of a url, which often carry
+// API keys, before it is logged.
+func redactUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "<invalid url>"
+	}
+
+	query := u.Query()
+	for k := range query {
+		query[k] = []string{"REDACTED"}
+	}
+	u.RawQuery = query.Encode()
+
+	return u.Redacted()
+}
+
+func formatValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case nil:
+		return "", nil
+	}
+
+	return "", fmt.Errorf("need string, number or boolean, but got %v", v)
+}
+
+// do sends the request with client and reads the whole response.
+func (r *httpRequest) do(ctx context.Context, client *http.Client) (response *httpResponse, err error) {
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
+	var body io.Reader
+	if r.body != nil {
+		body = bytes.NewReader(r.body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, r.method, r.url, body)
+	if err != nil {
+		return
+	}
+	req.Header = r.headers.Clone()
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = redactUrl(urlErr.URL)
+	}
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+
+	return &httpResponse{
+		status:  resp.StatusCode,
+		header:  resp.Header,
+		url:     resp.Request.URL.String(),
+		elapsed: time.Since(start),
+		body:    b,
+		charset: r.charset,
+	}, nil
+}
+
+// send sends the request with the context, retry policy and run log of the
+// script. Temporary network errors and retryable statuses are retried as the
+// policy says. It returns a Response when the script asked for one, and
+// otherwise the body converted with the content type dispatch get() has
+// always used. Statuses outside of 2xx fail with a *StatusError unless
+// allowed.
+func (r *httpRequest) send(i *lox.Interpreter, client *http.Client) (v interface{}, err error) {
+	ctx := scriptContext(i)
+	logger := scriptLogger(i)
+
+	policy := retryPolicy(i)
+	if r.retry != nil {
+		policy, err = policy.withOptions("request", r.retry)
+		if err != nil {
+			return
+		}
+	}
+
+	attempts := policy.MaxAttempts
+	if !policy.retriesMethod(r.method) {
+		attempts = 1
+	}
+
+	var response *httpResponse
+	for attempt := 1; ; attempt++ {
+		response, err = r.do(ctx, client)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		var header http.Header
+		reason := err
+		if err == nil {
+			if !policy.retries(response.status) {
+				break
+			}
+
+			header = response.header
+			reason = fmt.Errorf("status %d", response.status)
+		} else if !temporary(err) {
+			break
+		}
+
+		if attempt >= attempts {
+			break
+		}
+
+		delay, ok := policy.delay(attempt, header)
+		if !ok {
+			logger.Printf("%s %s attempt %d/%d failed: %v, not retrying as Retry-After %s is over %s", r.method, redactUrl(r.url), attempt, attempts, reason, delay, policy.MaxBackoff)
+			break
+		}
+
+		logger.Printf("%s %s attempt %d/%d failed: %v, retrying in %s", r.method, redactUrl(r.url), attempt, attempts, reason, delay.Round(time.Millisecond))
+		err = sleepContext(ctx, delay)
+		if err != nil {
+			return
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	if !r.allowErrors && (response.status < 200 || response.status > 299) {
+		return nil, &StatusError{
+			Method:     r.method,
+			URL:        redactUrl(r.url),
+			StatusCode: response.status,
+			Status:     fmt.Sprintf("%d %s", response.status, http.StatusText(response.status)),
+		}
+	}
+
+	if r.response {
+		return newResponseInstance(response), nil
+	}
+
+	return response.value()
+}
+
+var _ lox.Callable = (*RequestFunction)(nil)
+
+// RequestFunction is request(options). See parseRequest for the options.
+type RequestFunction struct {
+}
+
+func (f RequestFunction) Call(i *lox.Interpreter, arguments []interface{}) (v interface{}, err error) {
+	options, ok := arguments[0].(lox.DictType)
+	if !ok {
+		return nil, fmt.Errorf("request() 1st argument need dictionary, but got %v", arguments[0])
+	}
+
+	r, err := parseRequest("request", options)
+	if err != nil {
+		return
+	}
+
+	return r.send(i, http.DefaultClient)
+}
+
+func (f RequestFunction) Arity() int {
+	return 1
+}
+
+func (f RequestFunction) ToString() string {
+	return "<native fn Request>"
+}
+
+func (f RequestFunction) Bind(instance *lox.LoxInstance) lox.Callable {
+	return f
+}
@@ -0,0 +1,101 @@
+package bus_tracker
+
+import (
+	lox "github.com/ariyn/lox_interpreter"
+	"testing"
+	"time"
+)
+
+func TestParseRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		options     lox.DictType
+		method      string
+		url         string
+		contentType string
+		body        string
+		timeout     time.Duration
+		wantErr     bool
+	}{
+		{"defaults", lox.DictType{"url": "https://example.com/a"}, "GET", "https://example.com/a", "", "", 0, false},
+		{"method", lox.DictType{"url": "https://example.com", "method": "delete"}, "DELETE", "https://example.com", "", "", 0, false},
+		{"query", lox.DictType{
+			"url":   "https://example.com/a?x=1",
+			"query": lox.DictType{"b": lox.ListType{"2", 3.0}, "a": true},
+		}, "GET", "https://example.com/a?a=true&b=2&b=3&x=1", "", "", 0, false},
+		{"json", lox.DictType{
+			"url":  "https://example.com",
+			"json": lox.DictType{"stop": "1234"},
+		}, "GET", "https://example.com", "application/json", `{"stop":"1234"}`, 0, false},
+		{"form", lox.DictType{
+			"url":    "https://example.com",
+			"method": "post",
+			"form":   lox.DictType{"q": "bus stop", "n": 1.5},
+		}, "POST", "https://example.com", "application/x-www-form-urlencoded", "n=1.5&q=bus+stop", 0, false},
+		{"body keeps content type", lox.DictType{
+			"url":     "https://example.com",
+			"body":    "<xml/>",
+			"headers": lox.DictType{"content-type": "text/xml"},
+		}, "GET", "https://example.com", "text/xml", "<xml/>", 0, false},
+		{"timeout", lox.DictType{"url": "https://example.com", "timeout": 1.5}, "GET", "https://example.com", "", "", 1500 * time.Millisecond, false},
+		{"no url", lox.DictType{}, "", "", "", "", 0, true},
+		{"relative url", lox.DictType{"url": "/a"}, "", "", "", "", 0, true},
+		{"url without scheme", lox.DictType{"url": "example.com/a"}, "", "", "", "", 0, true},
+		{"url without host", lox.DictType{"url": "https:///a"}, "", "", "", "", 0, true},
+		{"unknown option", lox.DictType{"url": "https://example.com", "cookies": "a"}, "", "", "", "", 0, true},
+		{"two bodies", lox.DictType{"url": "https://example.com", "body": "a", "json": "b"}, "", "", "", "", 0, true},
+		{"zero timeout", lox.DictType{"url": "https://example.com", "timeout": 0.0}, "", "", "", "", 0, true},
+		{"header not a string", lox.DictType{"url": "https://example.com", "headers": lox.DictType{"X-Count": 1.0}}, "", "", "", "", 0, true},
+		{"query list of dictionaries", lox.DictType{"url": "https://example.com", "query": lox.DictType{"a": lox.ListType{lox.DictType{}}}}, "", "", "", "", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := parseRequest("request", tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if r.method != tt.method || r.url != tt.url {
+				t.Errorf("parseRequest() = %s %s, want %s %s", r.method, r.url, tt.method, tt.url)
+			}
+			if got := r.headers.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if string(r.body) != tt.body {
+				t.Errorf("body = %q, want %q", r.body, tt.body)
+			}
+			if r.timeout != tt.timeout {
+				t.Errorf("timeout = %v, want %v", r.timeout, tt.timeout)
+			}
+		})
+	}
+}
+
+func TestAbsoluteUrl(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"https://example.com/a?b=c", false},
+		{"http://localhost:8080", false},
+		{"/relative/path", true},
+		{"relative/path", true},
+		{"example.com/a", true},
+		{"mailto:someone@example.com", true},
+		{"https://", true},
+		{"://example.com", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			_, err := absoluteUrl("request", tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("absoluteUrl(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package bus_tracker
+
+import (
+	"fmt"
+	lox "github.com/ariyn/lox_interpreter"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// StatusError is returned for responses outside of 2xx, unless the script
+// allows them. The query values of URL are redacted, as they often carry API
+// keys.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s returned %s", e.Method, e.URL, e.Status)
+}
+
+// httpResponse is a response read to the end, so it outlives the request's
+// context.
+type httpResponse struct {
+	status  int
+	header  http.Header
+	url     string
+	elapsed time.Duration
+	body    []byte
+	// charset overrides the charset text bodies are decoded with.
+	charset string
+}
+
+// text returns the body, transcoded to UTF-8 when it is text.
+func (response *httpResponse) text() ([]byte, error) {
+	contentType := response.header.Get("Content-Type")
+	if !isText(contentType) {
+		return response.body, nil
+	}
+
+	return decodeText(response.body, contentType, response.charset)
+}
+
+// value converts the body with the content type dispatch get() uses.
+func (response *httpResponse) value() (v interface{}, err error) {
+	body, err := response.text()
+	if err != nil {
+		return
+	}
+
+	return responseValue(response.url, response.header, body)
+}
+
+func newResponseInstance(response *httpResponse) *lox.LoxInstance {
+	instance := lox.NewLoxInstance(
+		lox.NewLoxClass("Response", nil, map[string]lox.Callable{
+			"status": newResponseFunction("status", 0, func(response *httpResponse, _ []any) (v interface{}, err error) {
+				return float64(response.status), nil
+			}),
+			"header": newResponseFunction("header", 1, func(response *httpResponse, arguments []any) (v interface{}, err error) {
+				name, err := stringArgument("header", 0, arguments)
+				if err != nil {
+					return
+				}
+
+				if values := response.header.Values(name); len(values) > 0 {
+					return strings.Join(values, ", "), nil
+				}
+
+				return nil, nil
+			}),
+			// headers returns every header under its lower case name. Repeated
+			// headers are joined with commas.
+			"headers": newResponseFunction("headers", 0, func(response *httpResponse, _ []any) (v interface{}, err error) {
+				headers := make(lox.DictType, len(response.header))
+				for name, values := range response.header {
+					headers[strings.ToLower(name)] = strings.Join(values, ", ")
+				}
+
+				return headers, nil
+			}),
+			// url is where the response came from, after redirects.
+			"url": newResponseFunction("url", 0, func(response *httpResponse, _ []any) (v interface{}, err error) {
+				return response.url, nil
+			}),
+			// elapsed is how many seconds the request took, body included.
+			"elapsed": newResponseFunction("elapsed", 0, func(response *httpResponse, _ []any) (v interface{}, err error) {
+				return response.elapsed.Seconds(), nil
+			}),
+			// body converts the body by its content type like get() does. Other
+			// content types are returned as a string.
+			"body": newResponseFunction("body", 0, func(response *httpResponse, _ []any) (v interface{}, err error) {
+				if !isDispatched(response.header.Get("Content-Type")) {
+					body, err := response.text()
+					return string(body), err
+				}
+
+				return response.value()
+			}),
+		}))
+
+	_ = instance.Set(lox.Token{Lexeme: "_response"}, lox.NewLiteralExpr(response))
+
+	return instance
+}
+
+// isDispatched tells whether responseValue converts the content type.
+func isDispatched(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/json") ||
+		strings.HasPrefix(contentType, "text/html") ||
+		strings.HasPrefix(contentType, "image/")
+}
+
+type responseFunctionCall func(response *httpResponse, arguments []any) (v interface{}, err error)
+
+var _ lox.Callable = (*ResponseFunction)(nil)
+
+type ResponseFunction struct {
+	instance *lox.LoxInstance
+	arity    int
+	call     responseFunctionCall
+	name     string
+}
+
+func newResponseFunction(name string, arity int, call responseFunctionCall) *ResponseFunction {
+	return &ResponseFunction{
+		arity: arity,
+		call:  call,
+		name:  name,
+	}
+}
+
+func (f ResponseFunction) Call(_ *lox.Interpreter, arguments []interface{}) (v interface{}, err error) {
+	response, err := f.instance.Get(lox.Token{Lexeme: "_response"})
+	if err != nil {
+		return
+	}
+
+	_, isResponse := response.(*httpResponse)
+	if !isResponse {
+		return nil, fmt.Errorf("is not Response")
+	}
+
+	return f.call(response.(*httpResponse), arguments)
+}
+
+func (f ResponseFunction) Arity() int {
+	return f.arity
+}
+
+func (f ResponseFunction) ToString() string {
+	return fmt.Sprintf("<native fn %s>", f.name)
+}
+
+func (f ResponseFunction) Bind(instance *lox.LoxInstance) lox.Callable {
+	f.instance = instance
+	return f
+}
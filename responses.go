@@ -0,0 +1,255 @@
+package bus_tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ariyn/bus-tracker/functions"
+	lox "github.com/ariyn/lox_interpreter"
+	"github.com/playwright-community/playwright-go"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// maxRecordedResponses bounds how many responses a page keeps, so a page that
+// polls forever can't exhaust memory. The oldest are dropped first.
+const maxRecordedResponses = 1000
+
+// recordedResponse is an XHR or fetch response the page received. Its body is
+// read in the background, as playwright can't be called from inside its own
+// event handlers; done is closed once it is.
+type recordedResponse struct {
+	url     string
+	status  int
+	headers map[string]string
+	body    []byte
+	done    chan struct{}
+}
+
+// responseRecorder keeps the XHR and fetch responses of a page from the
+// moment it is opened, so data loaded before the script asks for it is not
+// lost.
+type responseRecorder struct {
+	mu       sync.Mutex
+	recorded []*recordedResponse
+	// changed is closed and replaced whenever a response is recorded.
+	changed chan struct{}
+	// waited is how many recorded responses waitForResponse has gone past.
+	waited int
+}
+
+func recordResponses(page playwright.Page) *responseRecorder {
+	r := &responseRecorder{
+		changed: make(chan struct{}),
+	}
+
+	page.OnResponse(func(response playwright.Response) {
+		resourceType := response.Request().ResourceType()
+		if resourceType != "xhr" && resourceType != "fetch" {
+			return
+		}
+
+		recorded := &recordedResponse{
+			url:     response.URL(),
+			status:  response.Status(),
+			headers: response.Headers(),
+			done:    make(chan struct{}),
+		}
+
+		r.mu.Lock()
+		if len(r.recorded) >= maxRecordedResponses {
+			r.recorded = r.recorded[1:]
+			r.waited = max(r.waited-1, 0)
+		}
+		r.recorded = append(r.recorded, recorded)
+		close(r.changed)
+		r.changed = make(chan struct{})
+		r.mu.Unlock()
+
+		go func() {
+			defer close(recorded.done)
+
+			// Redirects and aborted requests have no body.
+			body, err := response.Body()
+			if err == nil {
+				recorded.body = body
+			}
+		}()
+	})
+
+	return r
+}
+
+// waitForResponse returns the next response whose URL matches pattern,
+// waiting for it until the script times out. Responses that arrived before
+// the call count too, so it can't miss one that loaded with the page. Each
+// call starts after the response the previous one returned.
+func (r *responseRecorder) waitForResponse(ctx context.Context, _ playwright.Page, arguments []any) (v interface{}, err error) {
+	pattern, err := stringArgument("waitForResponse", 0, arguments)
+	if err != nil {
+		return
+	}
+
+	match, err := urlMatcher(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("waitForResponse() %v", err)
+	}
+
+	for {
+		r.mu.Lock()
+		var found *recordedResponse
+		for i := r.waited; i < len(r.recorded); i++ {
+			if match(r.recorded[i].url) {
+				found = r.recorded[i]
+				r.waited = i + 1
+				break
+			}
+		}
+		changed := r.changed
+		r.mu.Unlock()
+
+		if found != nil {
+			return found.toLox(ctx)
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// responses returns every response so far whose URL matches pattern, oldest
+// first.
+func (r *responseRecorder) responses(ctx context.Context, _ playwright.Page, arguments []any) (v interface{}, err error) {
+	pattern, err := stringArgument("responses", 0, arguments)
+	if err != nil {
+		return
+	}
+
+	match, err := urlMatcher(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("responses() %v", err)
+	}
+
+	r.mu.Lock()
+	var matched []*recordedResponse
+	for _, recorded := range r.recorded {
+		if match(recorded.url) {
+			matched = append(matched, recorded)
+		}
+	}
+	r.mu.Unlock()
+
+	list := make(lox.ListType, len(matched))
+	for i, recorded := range matched {
+		list[i], err = recorded.toLox(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return list, nil
+}
+
+// toLox waits for the body and returns a dictionary with url, status,
+// headers and body. A JSON body is parsed into Lox values and is also given
+// as data, the CrawlData get() returns for JSON; an HTML body is given as
+// data too.
+func (recorded *recordedResponse) toLox(ctx context.Context) (v interface{}, err error) {
+	select {
+	case <-recorded.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	headers := make(lox.DictType, len(recorded.headers))
+	for k, value := range recorded.headers {
+		headers[k] = value
+	}
+
+	response := lox.DictType{
+		"url":     recorded.url,
+		"status":  float64(recorded.status),
+		"headers": headers,
+		"body":    nil,
+		"data":    nil,
+	}
+
+	if recorded.body == nil {
+		return response, nil
+	}
+
+	contentType := recorded.headers["content-type"]
+	body := recorded.body
+	if isText(contentType) {
+		body, err = decodeText(body, contentType, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+	response["body"] = string(body)
+
+	switch {
+	case strings.Contains(contentType, "json"):
+		var parsed interface{}
+		if json.Unmarshal(body, &parsed) != nil {
+			break
+		}
+
+		response["body"], err = toLoxValue(parsed)
+		if err != nil {
+			return nil, err
+		}
+
+		var xml string
+		xml, err = convertJsonToXmlString(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		response["data"], err = functions.NewCrawlDataInstance(xml)
+		if err != nil {
+			return nil, err
+		}
+	case strings.HasPrefix(contentType, "text/html"):
+		response["data"], err = functions.NewCrawlDataInstance(string(body))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return response, nil
+}
+
+// urlMatcher matches whole URLs against a glob, where * matches anything,
+// e.g. **/api/arrivals* or *google-analytics*. A pattern without wildcards
+// matches URLs that contain it.
+func urlMatcher(pattern string) (match func(url string) bool, err error) {
+	if !strings.Contains(pattern, "*") {
+		return func(url string) bool {
+			return strings.Contains(url, pattern)
+		}, nil
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '*' {
+			expr.WriteString(".*")
+		} else {
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	expr.WriteString("$")
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %s: %v", pattern, err)
+	}
+
+	return re.MatchString, nil
+}
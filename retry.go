@@ -0,0 +1,352 @@
+package bus_tracker
+
+import (
+	"errors"
+	"fmt"
+	lox "github.com/ariyn/lox_interpreter"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const retryKey = "_retry"
+
+// RetryPolicy decides how often and how patiently get(), request() and
+// sessions retry a request that hit a temporary network error or got a
+// retryable status.
+type RetryPolicy struct {
+	// MaxAttempts counts the first attempt too, so 1 never retries.
+	MaxAttempts int
+	// Backoff is the delay before the first retry. It doubles for every
+	// retry after that.
+	Backoff time.Duration
+	// MaxBackoff caps the delay. A Retry-After longer than it fails the
+	// request instead of waiting less than the server asked.
+	MaxBackoff time.Duration
+	// Jitter, from 0 to 1, is the share of each delay that is randomized so
+	// that parallel runs don't retry in lockstep.
+	Jitter float64
+	// StatusCodes are the response statuses that are retried.
+	StatusCodes []int
+	// Methods are the request methods that are retried. Methods that are
+	// not idempotent, like POST, are left out by default since the server
+	// may have processed the request before it failed.
+	Methods []string
+	// RetryAfter waits as long as a Retry-After header asks, when it is
+	// longer than the backoff.
+	RetryAfter bool
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     1 * time.Second,
+		MaxBackoff:  30 * time.Second,
+		Jitter:      0.2,
+		StatusCodes: []int{
+			http.StatusRequestTimeout,
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+		Methods: []string{
+			http.MethodGet,
+			http.MethodHead,
+			http.MethodPut,
+			http.MethodDelete,
+			http.MethodOptions,
+		},
+		RetryAfter: true,
+	}
+}
+
+// RetryPolicyFromEnv reads HTTP_RETRY_ATTEMPTS, HTTP_RETRY_BACKOFF,
+// HTTP_RETRY_MAX_BACKOFF, and HTTP_RETRY_STATUSES and HTTP_RETRY_METHODS,
+// comma separated lists, falling back to DefaultRetryPolicy for unset ones.
+func RetryPolicyFromEnv() (policy RetryPolicy, err error) {
+	policy = DefaultRetryPolicy()
+
+	if v := os.Getenv("HTTP_RETRY_ATTEMPTS"); v != "" {
+		policy.MaxAttempts, err = strconv.Atoi(v)
+		if err != nil || policy.MaxAttempts < 1 {
+			return policy, fmt.Errorf("invalid HTTP_RETRY_ATTEMPTS: %s", v)
+		}
+	}
+
+	if v := os.Getenv("HTTP_RETRY_BACKOFF"); v != "" {
+		policy.Backoff, err = time.ParseDuration(v)
+		if err != nil {
+			return policy, fmt.Errorf("invalid HTTP_RETRY_BACKOFF: %v", err)
+		}
+	}
+
+	if v := os.Getenv("HTTP_RETRY_MAX_BACKOFF"); v != "" {
+		policy.MaxBackoff, err = time.ParseDuration(v)
+		if err != nil {
+			return policy, fmt.Errorf("invalid HTTP_RETRY_MAX_BACKOFF: %v", err)
+		}
+	}
+
+	if v := os.Getenv("HTTP_RETRY_STATUSES"); v != "" {
+		policy.StatusCodes = nil
+		for _, s := range strings.Split(v, ",") {
+			code, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return policy, fmt.Errorf("invalid HTTP_RETRY_STATUSES: %v", err)
+			}
+			policy.StatusCodes = append(policy.StatusCodes, code)
+		}
+	}
+
+	if v := os.Getenv("HTTP_RETRY_METHODS"); v != "" {
+		policy.Methods = nil
+		for _, method := range strings.Split(v, ",") {
+			policy.Methods = append(policy.Methods, strings.ToUpper(strings.TrimSpace(method)))
+		}
+	}
+
+	return policy, nil
+}
+
+// retryOptionKeys are the keys of the dictionary setRetry() and the retry
+// option of request() take.
+var retryOptionKeys = []string{"attempts", "backoff", "maxBackoff", "jitter", "statuses", "methods", "retryAfter"}
+
+// withOptions returns the policy with the fields a script set overridden.
+// Durations are in seconds.
+func (policy RetryPolicy) withOptions(name string, options lox.DictType) (RetryPolicy, error) {
+	for key := range options {
+		known := false
+		for _, k := range retryOptionKeys {
+			known = known || key == k
+		}
+
+		if !known {
+			return policy, fmt.Errorf("%s() got unknown retry option %s", name, key)
+		}
+	}
+
+	attempts, err := numberOption(name, options, "attempts")
+	if err != nil {
+		return policy, err
+	}
+	if attempts != nil {
+		if *attempts < 1 {
+			return policy, fmt.Errorf("%s() retry attempts must be at least 1, but got %v", name, *attempts)
+		}
+		policy.MaxAttempts = int(*attempts)
+	}
+
+	for key, field := range map[string]*time.Duration{"backoff": &policy.Backoff, "maxBackoff": &policy.MaxBackoff} {
+		seconds, err := numberOption(name, options, key)
+		if err != nil {
+			return policy, err
+		}
+		if seconds != nil {
+			if *seconds < 0 {
+				return policy, fmt.Errorf("%s() retry %s must not be negative, but got %v", name, key, *seconds)
+			}
+			*field = time.Duration(*seconds * float64(time.Second))
+		}
+	}
+
+	jitter, err := numberOption(name, options, "jitter")
+	if err != nil {
+		return policy, err
+	}
+	if jitter != nil {
+		if *jitter < 0 || *jitter > 1 {
+			return policy, fmt.Errorf("%s() retry jitter must be between 0 and 1, but got %v", name, *jitter)
+		}
+		policy.Jitter = *jitter
+	}
+
+	if v, ok := options["statuses"]; ok && v != nil {
+		list, ok := v.(lox.ListType)
+		if !ok {
+			return policy, fmt.Errorf("%s() retry statuses need list, but got %v", name, v)
+		}
+
+		policy.StatusCodes = nil
+		for _, item := range list {
+			code, ok := item.(float64)
+			if !ok {
+				return policy, fmt.Errorf("%s() retry statuses need numbers, but got %v", name, item)
+			}
+			policy.StatusCodes = append(policy.StatusCodes, int(code))
+		}
+	}
+
+	if v, ok := options["methods"]; ok && v != nil {
+		list, ok := v.(lox.ListType)
+		if !ok {
+			return policy, fmt.Errorf("%s() retry methods need list, but got %v", name, v)
+		}
+
+		policy.Methods = nil
+		for _, item := range list {
+			method, ok := item.(string)
+			if !ok {
+				return policy, fmt.Errorf("%s() retry methods need strings, but got %v", name, item)
+			}
+			policy.Methods = append(policy.Methods, strings.ToUpper(method))
+		}
+	}
+
+	retryAfter, err := boolOption(name, options, "retryAfter")
+	if err != nil {
+		return policy, err
+	}
+	if retryAfter != nil {
+		policy.RetryAfter = *retryAfter
+	}
+
+	return policy, nil
+}
+
+func (policy RetryPolicy) retries(status int) bool {
+	for _, code := range policy.StatusCodes {
+		if code == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (policy RetryPolicy) retriesMethod(method string) bool {
+	for _, m := range policy.Methods {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// temporary tells whether a failed request may succeed when sent again.
+// Refused and reset connections, timeouts and responses cut short are;
+// errors such as an unknown host, a bad url or a failed TLS handshake are
+// not, and fail without waiting for a retry.
+func temporary(err error) bool {
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// delay is how long to wait after the given failed attempt, counting from 1.
+// It returns false when the server asked for a longer wait than MaxBackoff.
+func (policy RetryPolicy) delay(attempt int, header http.Header) (time.Duration, bool) {
+	delay := policy.Backoff
+	for i := 1; i < attempt && delay < policy.MaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, policy.MaxBackoff)
+
+	if policy.Jitter > 0 {
+		delay = time.Duration(float64(delay) * (1 - policy.Jitter*rand.Float64()))
+	}
+
+	if policy.RetryAfter && header != nil {
+		if after, ok := retryAfter(header.Get("Retry-After")); ok && after > delay {
+			if after > policy.MaxBackoff {
+				return after, false
+			}
+			delay = after
+		}
+	}
+
+	return delay, true
+}
+
+// retryAfter parses a Retry-After header, given in seconds or as a date.
+func retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+
+	return 0, false
+}
+
+// retryPolicy returns the policy requests of the script use unless they set
+// their own.
+func retryPolicy(i *lox.Interpreter) RetryPolicy {
+	v, err := i.Globals.Get(lox.Token{Lexeme: retryKey})
+	if err != nil {
+		return DefaultRetryPolicy()
+	}
+
+	policy, ok := v.(*RetryPolicy)
+	if !ok {
+		return DefaultRetryPolicy()
+	}
+
+	return *policy
+}
+
+var _ lox.Callable = (*SetRetryFunction)(nil)
+
+// SetRetryFunction is setRetry(options). It changes the retry policy of
+// every request the script makes after it, e.g.
+// setRetry({attempts: 5, backoff: 2, statuses: [429, 503]}). POST is only
+// retried when methods lists it.
+type SetRetryFunction struct {
+}
+
+func (f SetRetryFunction) Call(i *lox.Interpreter, arguments []interface{}) (v interface{}, err error) {
+	options, err := optionsArgument("setRetry", 0, arguments, retryOptionKeys...)
+	if err != nil {
+		return
+	}
+
+	current, err := i.Globals.Get(lox.Token{Lexeme: retryKey})
+	if err != nil {
+		return
+	}
+
+	policy, ok := current.(*RetryPolicy)
+	if !ok {
+		return nil, fmt.Errorf("retry policy is not set up")
+	}
+
+	*policy, err = policy.withOptions("setRetry", options)
+	return nil, err
+}
+
+func (f SetRetryFunction) Arity() int {
+	return 1
+}
+
+func (f SetRetryFunction) ToString() string {
+	return "<native fn SetRetry>"
+}
+
+func (f SetRetryFunction) Bind(instance *lox.LoxInstance) lox.Callable {
+	return f
+}
@@ -1,30 +1,80 @@
 package bus_tracker
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/ariyn/bus-tracker/storage"
 	lox "github.com/ariyn/lox_interpreter"
 	"github.com/playwright-community/playwright-go"
+	"log"
 	"strconv"
+	"sync"
 	"time"
 )
 
+const contextKey = "_context"
+const browsersKey = "_browsers"
+const optionsKey = "_options"
+
+// ScriptOptions are the services a script runs with.
+type ScriptOptions struct {
+	// Storage keeps images saved by the script.
+	Storage storage.Storage
+	// History looks up earlier runs of the same function. It is nil when the
+	// script doesn't run as a function.
+	History History
+	// States keeps the browser states of the function. It is nil when states
+	// are not kept.
+	States BrowserStates
+	// Retry is the retry policy of the script's HTTP requests, until the
+	// script changes it. DefaultRetryPolicy is used when it is nil.
+	Retry *RetryPolicy
+	// Logger is the run log, e.g. of retried requests. The standard logger
+	// is used when it is nil.
+	Logger *log.Logger
+}
+
+// History gives a script access to what earlier runs of its function
+// returned.
+type History interface {
+	// PreviousImage returns the first image returned by the latest
+	// successful run that returned one, or nil when there is none.
+	PreviousImage(ctx context.Context) (*Image, error)
+}
+
 func init() {
 	lox.NO_RETURN_AT_ROOT = false
 }
 
+// TimeoutError is returned by Run when the script is stopped because its
+// context was cancelled or its deadline exceeded.
+type TimeoutError struct {
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("script stopped: %v", e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
 type BusTrackerScript struct {
 	statements  []lox.Stmt
 	interpreter *lox.Interpreter
+	browsers    *openBrowsers
 }
 
-func NewBusTrackerScript(script string, envVar map[string]string) (bt *BusTrackerScript, err error) {
+func NewBusTrackerScript(script string, envVar map[string]string, options ScriptOptions) (bt *BusTrackerScript, err error) {
 	scanner := lox.NewScanner(script)
 	tokens, err := scanner.ScanTokens()
 	if err != nil {
 		return
 	}
 
-	parser := lox.NewParser(tokens)
+	parser := lox.NewParser(withCheckpoints(tokens))
 	statements, err := parser.Parse()
 	if err != nil {
 		return
@@ -32,14 +82,31 @@ func NewBusTrackerScript(script string, envVar map[string]string) (bt *BusTracke
 
 	env := lox.NewEnvironment(nil)
 	env.Define("get", &GetFunction{})
+	env.Define("request", &RequestFunction{})
+	env.Define("session", &SessionConstructor{})
+	env.Define("sessionWith", &SessionConstructor{withOptions: true})
 	env.Define("browser", &BrowserGetFunction{})
+	env.Define("browserWith", &BrowserGetFunction{withOptions: true})
 	env.Define("number", &NumberFunction{})
 	env.Define("sleep", &SleepFunction{})
+	env.Define("previousImage", &PreviousImageFunction{})
+	env.Define("setRetry", &SetRetryFunction{})
+	env.Define(checkpointKey, &CheckpointFunction{})
 
 	for k, v := range envVar {
 		env.Define(k, v)
 	}
 
+	browsers := &openBrowsers{}
+	env.Define(browsersKey, browsers)
+	env.Define(optionsKey, options)
+
+	retry := DefaultRetryPolicy()
+	if options.Retry != nil {
+		retry = *options.Retry
+	}
+	env.Define(retryKey, &retry)
+
 	interpreter := lox.NewInterpreter(env)
 
 	resolver := lox.NewResolver(interpreter)
@@ -51,33 +118,192 @@ func NewBusTrackerScript(script string, envVar map[string]string) (bt *BusTracke
 	return &BusTrackerScript{
 		statements:  statements,
 		interpreter: interpreter,
+		browsers:    browsers,
 	}, nil
 }
 
-func (bt *BusTrackerScript) Run() (v interface{}, err error) {
-	v, err = bt.interpreter.Interpret(bt.statements)
+// Run interprets the script until it returns or ctx is done. When ctx is done
+// first, every browser context opened by the script is closed and a
+// *TimeoutError is returned once the script has stopped: natives fail and
+// loops stop at their next checkpoint, but Run doesn't return while a native
+// that ignores ctx is still blocked.
+func (bt *BusTrackerScript) Run(ctx context.Context) (v interface{}, err error) {
+	bt.interpreter.Globals.Define(contextKey, ctx)
 
-	browsers, err2 := bt.interpreter.Env.Get(lox.Token{Lexeme: "_browsers"})
-	if err2 == nil && browsers != nil {
-		for _, browser := range browsers.([]playwright.Browser) {
-			err2 = browser.Close()
-			if err2 != nil {
-				return
+	type result struct {
+		v   interface{}
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- result{nil, fmt.Errorf("script panicked: %v", r)}
 			}
-		}
+		}()
+
+		v, err := bt.interpreter.Interpret(bt.statements)
+		done <- result{v, err}
+	}()
+
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		// Closing the browsers first unblocks natives waiting on a page.
+		_ = bt.browsers.closeAll()
+		r = <-done
+	}
+	v, err = r.v, r.err
+
+	if err != nil && ctx.Err() != nil {
+		err = &TimeoutError{Err: ctx.Err()}
+	}
+
+	err2 := bt.browsers.closeAll()
+	if err2 != nil && err == nil {
+		err = err2
 	}
 
 	if err != nil {
 		return
 	}
 
-	if instance, ok := v.(*lox.LoxInstance); ok {
-		if instance.ToString() == "<inst Image>" {
-			return instance.Get(lox.Token{Lexeme: "_image"})
+	return unwrapImages(v), nil
+}
+
+// unwrapImages replaces Image and File instances in a script's result,
+// however deeply nested in lists and dictionaries, with the *Image behind
+// them.
+func unwrapImages(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *lox.LoxInstance:
+		if v.ToString() == "<inst Image>" || v.ToString() == "<inst File>" {
+			image, err := v.Get(lox.Token{Lexeme: "_image"})
+			if err == nil {
+				return image
+			}
+		}
+	case lox.ListType:
+		unwrapped := make(lox.ListType, len(v))
+		for i, item := range v {
+			unwrapped[i] = unwrapImages(item)
 		}
+		return unwrapped
+	case lox.DictType:
+		unwrapped := make(lox.DictType, len(v))
+		for k, item := range v {
+			unwrapped[k] = unwrapImages(item)
+		}
+		return unwrapped
+	}
+
+	return v
+}
+
+// scriptContext returns the context given to Run, or context.Background when
+// the interpreter is used outside of Run.
+func scriptContext(i *lox.Interpreter) context.Context {
+	v, err := i.Globals.Get(lox.Token{Lexeme: contextKey})
+	if err != nil {
+		return context.Background()
+	}
+
+	ctx, ok := v.(context.Context)
+	if !ok {
+		return context.Background()
+	}
+
+	return ctx
+}
+
+// scriptLogger returns the run log of the script.
+func scriptLogger(i *lox.Interpreter) *log.Logger {
+	if logger := scriptOptions(i).Logger; logger != nil {
+		return logger
+	}
+
+	return log.Default()
+}
+
+// scriptOptions returns the options the script was created with.
+func scriptOptions(i *lox.Interpreter) ScriptOptions {
+	v, err := i.Globals.Get(lox.Token{Lexeme: optionsKey})
+	if err != nil {
+		return ScriptOptions{}
 	}
 
-	return v, nil
+	options, _ := v.(ScriptOptions)
+	return options
+}
+
+var errScriptStopped = errors.New("script has stopped")
+
+// openBrowsers keeps the browser leases taken by a script so Run can release
+// them, even while the script is still running.
+type openBrowsers struct {
+	mu     sync.Mutex
+	leases []*BrowserLease
+	// closed is set by closeAll. A script stopped by Run can still be
+	// acquiring a browser, which add then releases right away.
+	closed bool
+}
+
+// acquire leases a browser context from pool. Once the script holds a lease,
+// later contexts share its browser instead of waiting for another one, which
+// could never come while the script holds the last free browser.
+func (b *openBrowsers) acquire(ctx context.Context, pool *BrowserPool, options playwright.BrowserNewContextOptions) (lease *BrowserLease, err error) {
+	b.mu.Lock()
+	var first *BrowserLease
+	if len(b.leases) > 0 {
+		first = b.leases[0]
+	}
+	b.mu.Unlock()
+
+	if first != nil {
+		lease, err = first.Share(options)
+	} else {
+		lease, err = pool.Acquire(ctx, options)
+	}
+	if err != nil {
+		return
+	}
+
+	err = b.add(lease)
+	if err != nil {
+		return nil, err
+	}
+
+	return lease, nil
+}
+
+func (b *openBrowsers) add(lease *BrowserLease) error {
+	b.mu.Lock()
+	closed := b.closed
+	if !closed {
+		b.leases = append(b.leases, lease)
+	}
+	b.mu.Unlock()
+
+	if closed {
+		return errors.Join(errScriptStopped, lease.Release())
+	}
+
+	return nil
+}
+
+func (b *openBrowsers) closeAll() (err error) {
+	b.mu.Lock()
+	leases := b.leases
+	b.leases = nil
+	b.closed = true
+	b.mu.Unlock()
+
+	for _, lease := range leases {
+		err = errors.Join(err, lease.Release())
+	}
+
+	return
 }
 
 var _ lox.Callable = (*NumberFunction)(nil)
@@ -119,8 +345,19 @@ func (n SleepFunction) Call(interpreter *lox.Interpreter, arguments []interface{
 		return nil, fmt.Errorf("sleep() argument must be number")
 	}
 
-	time.Sleep(time.Duration(seconds) * time.Second)
-	return nil, nil
+	return nil, sleepContext(scriptContext(interpreter), time.Duration(seconds*float64(time.Second)))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
 
 func (n SleepFunction) Arity() int {
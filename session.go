@@ -0,0 +1,318 @@
+package bus_tracker
+
+import (
+	"fmt"
+	lox "github.com/ariyn/lox_interpreter"
+	"github.com/playwright-community/playwright-go"
+	"golang.org/x/net/publicsuffix"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// session is what session() returns: requests made through it share a
+// cookie jar, default headers and a base URL relative URLs resolve against.
+type session struct {
+	client  *http.Client
+	baseUrl *url.URL
+	headers map[string]string
+}
+
+func newSession(options lox.DictType) (s *session, err error) {
+	const name = "sessionWith"
+
+	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		return
+	}
+
+	s = &session{
+		client:  &http.Client{Jar: jar},
+		headers: make(map[string]string),
+	}
+
+	baseUrl, err := stringOption(name, options, "baseUrl")
+	if err != nil {
+		return
+	}
+	if baseUrl != nil {
+		s.baseUrl, err = url.Parse(*baseUrl)
+		if err != nil || !s.baseUrl.IsAbs() {
+			return nil, fmt.Errorf("%s() baseUrl must be an absolute url, but got %s", name, *baseUrl)
+		}
+	}
+
+	headers, err := dictOption(name, options, "headers")
+	if err != nil {
+		return
+	}
+	for k, v := range headers {
+		value, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s() header %s need string, but got %v", name, k, v)
+		}
+		s.headers[k] = value
+	}
+
+	return s, nil
+}
+
+// request builds a request from request() options, resolving the url
+// against the base URL and adding the default headers the options don't set.
+func (s *session) request(name string, options lox.DictType) (r *httpRequest, err error) {
+	rawUrl, err := stringOption(name, options, "url")
+	if err != nil {
+		return
+	}
+
+	if rawUrl != nil && s.baseUrl != nil {
+		ref, err := url.Parse(*rawUrl)
+		if err != nil {
+			return nil, fmt.Errorf("%s() invalid url %s: %v", name, *rawUrl, err)
+		}
+
+		resolved := make(lox.DictType, len(options))
+		for k, v := range options {
+			resolved[k] = v
+		}
+		resolved["url"] = s.baseUrl.ResolveReference(ref).String()
+		options = resolved
+	}
+
+	r, err = parseRequest(name, options)
+	if err != nil {
+		return
+	}
+
+	for k, v := range s.headers {
+		setDefaultHeader(r.headers, k, v)
+	}
+
+	return r, nil
+}
+
+// importCookies copies the cookies of a browser() page into the jar, so a
+// login done in the browser carries over to plain requests.
+func (s *session) importCookies(page playwright.Page) (n int, err error) {
+	cookies, err := page.Context().Cookies()
+	if err != nil {
+		return 0, fmt.Errorf("could not read browser cookies: %v", err)
+	}
+
+	for _, c := range cookies {
+		scheme := "http"
+		if c.Secure {
+			scheme = "https"
+		}
+
+		host := strings.TrimPrefix(c.Domain, ".")
+		cookie := &http.Cookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+		}
+
+		// A leading dot means the cookie is sent to subdomains too; without
+		// one it is host only, which the jar expects as an empty Domain.
+		if strings.HasPrefix(c.Domain, ".") {
+			cookie.Domain = host
+		}
+
+		// Browser session cookies have no expiry and are kept as they are.
+		if c.Expires > 0 {
+			cookie.Expires = time.Unix(int64(c.Expires), 0)
+		}
+
+		s.client.Jar.SetCookies(&url.URL{Scheme: scheme, Host: host, Path: "/"}, []*http.Cookie{cookie})
+		n++
+	}
+
+	return n, nil
+}
+
+func newSessionInstance(s *session) *lox.LoxInstance {
+	instance := lox.NewLoxInstance(
+		lox.NewLoxClass("Session", nil, map[string]lox.Callable{
+			"get": newSessionFunction("get", 1, func(i *lox.Interpreter, s *session, arguments []any) (v interface{}, err error) {
+				rawUrl, err := stringArgument("get", 0, arguments)
+				if err != nil {
+					return
+				}
+
+				r, err := s.request("get", lox.DictType{"url": rawUrl})
+				if err != nil {
+					return
+				}
+
+				return r.send(i, s.client)
+			}),
+			// post takes the url and request() options without method and url,
+			// e.g. post("/search", {form: {q: "bus"}}).
+			"post": newSessionFunction("post", 2, func(i *lox.Interpreter, s *session, arguments []any) (v interface{}, err error) {
+				rawUrl, err := stringArgument("post", 0, arguments)
+				if err != nil {
+					return
+				}
+
+				options, ok := arguments[1].(lox.DictType)
+				if !ok {
+					return nil, fmt.Errorf("post() argument 2 need dictionary, but got %v", arguments[1])
+				}
+
+				if _, ok := options["url"]; ok {
+					return nil, fmt.Errorf("post() takes the url as its 1st argument")
+				}
+
+				if _, ok := options["method"]; ok {
+					return nil, fmt.Errorf("post() always uses POST")
+				}
+
+				withUrl := make(lox.DictType, len(options)+2)
+				for k, v := range options {
+					withUrl[k] = v
+				}
+				withUrl["url"] = rawUrl
+				withUrl["method"] = http.MethodPost
+
+				r, err := s.request("post", withUrl)
+				if err != nil {
+					return
+				}
+
+				return r.send(i, s.client)
+			}),
+			"request": newSessionFunction("request", 1, func(i *lox.Interpreter, s *session, arguments []any) (v interface{}, err error) {
+				options, ok := arguments[0].(lox.DictType)
+				if !ok {
+					return nil, fmt.Errorf("request() 1st argument need dictionary, but got %v", arguments[0])
+				}
+
+				r, err := s.request("request", options)
+				if err != nil {
+					return
+				}
+
+				return r.send(i, s.client)
+			}),
+			// importCookies takes a browser() page and returns how many cookies
+			// it imported.
+			"importCookies": newSessionFunction("importCookies", 1, func(_ *lox.Interpreter, s *session, arguments []any) (v interface{}, err error) {
+				instance, ok := arguments[0].(*lox.LoxInstance)
+				if ok {
+					page, err := instance.Get(lox.Token{Lexeme: "page"})
+					if p, isPage := page.(playwright.Page); err == nil && isPage {
+						n, err := s.importCookies(p)
+						return float64(n), err
+					}
+				}
+
+				return nil, fmt.Errorf("importCookies() 1st argument need Page, but got %v", arguments[0])
+			}),
+		}))
+
+	_ = instance.Set(lox.Token{Lexeme: "_session"}, lox.NewLiteralExpr(s))
+
+	return instance
+}
+
+type sessionFunctionCall func(i *lox.Interpreter, s *session, arguments []any) (v interface{}, err error)
+
+var _ lox.Callable = (*SessionFunction)(nil)
+
+type SessionFunction struct {
+	instance *lox.LoxInstance
+	arity    int
+	call     sessionFunctionCall
+	name     string
+}
+
+func newSessionFunction(name string, arity int, call sessionFunctionCall) *SessionFunction {
+	return &SessionFunction{
+		arity: arity,
+		call:  call,
+		name:  name,
+	}
+}
+
+func (f SessionFunction) Call(i *lox.Interpreter, arguments []interface{}) (v interface{}, err error) {
+	s, err := f.instance.Get(lox.Token{Lexeme: "_session"})
+	if err != nil {
+		return
+	}
+
+	_, isSession := s.(*session)
+	if !isSession {
+		return nil, fmt.Errorf("is not Session")
+	}
+
+	ctx := scriptContext(i)
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return f.call(i, s.(*session), arguments)
+}
+
+func (f SessionFunction) Arity() int {
+	return f.arity
+}
+
+func (f SessionFunction) ToString() string {
+	return fmt.Sprintf("<native fn %s>", f.name)
+}
+
+func (f SessionFunction) Bind(instance *lox.LoxInstance) lox.Callable {
+	f.instance = instance
+	return f
+}
+
+var _ lox.Callable = (*SessionConstructor)(nil)
+
+// SessionConstructor is session(), or sessionWith(options) when withOptions
+// is set. The options are
+//   - baseUrl: the absolute url relative urls resolve against
+//   - headers: {name: value} sent with every request that doesn't set them
+type SessionConstructor struct {
+	withOptions bool
+}
+
+func (f SessionConstructor) Call(_ *lox.Interpreter, arguments []interface{}) (v interface{}, err error) {
+	options := lox.DictType{}
+	if f.withOptions {
+		options, err = optionsArgument("sessionWith", 0, arguments, "baseUrl", "headers")
+		if err != nil {
+			return
+		}
+	}
+
+	s, err := newSession(options)
+	if err != nil {
+		return
+	}
+
+	return newSessionInstance(s), nil
+}
+
+func (f SessionConstructor) Arity() int {
+	if f.withOptions {
+		return 1
+	}
+
+	return 0
+}
+
+func (f SessionConstructor) ToString() string {
+	if f.withOptions {
+		return "<native fn SessionWith>"
+	}
+
+	return "<native fn Session>"
+}
+
+func (f SessionConstructor) Bind(instance *lox.LoxInstance) lox.Callable {
+	return f
+}
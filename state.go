@@ -0,0 +1,152 @@
+package bus_tracker
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/playwright-community/playwright-go"
+	"os"
+)
+
+// defaultStateKey is the state browser() loads and saveState() writes when
+// the script does not name one.
+const defaultStateKey = "default"
+
+// BrowserStates keeps the browser storage state, cookies and localStorage,
+// of one function between runs, so a script logs in once instead of on every
+// run. A function can keep several states under different keys.
+type BrowserStates interface {
+	// LoadState returns nil when there is no state for key.
+	LoadState(ctx context.Context, key string) ([]byte, error)
+	SaveState(ctx context.Context, key string, state []byte) error
+}
+
+// BrowserStateKeyFromEnv reads BROWSER_STATE_KEY, the base64 encoded 32 byte
+// key states are encrypted with. It returns nil when the key is not set, in
+// which case states should not be kept at all.
+func BrowserStateKeyFromEnv() (key []byte, err error) {
+	v := os.Getenv("BROWSER_STATE_KEY")
+	if v == "" {
+		return nil, nil
+	}
+
+	key, err = base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BROWSER_STATE_KEY: %v", err)
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("BROWSER_STATE_KEY must be 32 bytes, but got %d", len(key))
+	}
+
+	return key, nil
+}
+
+type encryptedStates struct {
+	states   BrowserStates
+	function string
+	aead     cipher.AEAD
+}
+
+// NewEncryptedStates encrypts states with AES-256-GCM before they reach
+// states, so cookies are never stored in the clear. function identifies the
+// function the states belong to. It is authenticated along with the state
+// key, so a state can't be swapped in under another key or another function.
+func NewEncryptedStates(states BrowserStates, function string, key []byte) (BrowserStates, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return encryptedStates{states: states, function: function, aead: aead}, nil
+}
+
+// additionalData is what a state is bound to besides its contents.
+func (e encryptedStates) additionalData(key string) []byte {
+	return []byte(e.function + "\x00" + key)
+}
+
+func (e encryptedStates) LoadState(ctx context.Context, key string) ([]byte, error) {
+	sealed, err := e.states.LoadState(ctx, key)
+	if err != nil || sealed == nil {
+		return nil, err
+	}
+
+	size := e.aead.NonceSize()
+	if len(sealed) < size {
+		return nil, fmt.Errorf("browser state %s is corrupted", key)
+	}
+
+	state, err := e.aead.Open(nil, sealed[:size], sealed[size:], e.additionalData(key))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt browser state %s: %v", key, err)
+	}
+
+	return state, nil
+}
+
+func (e encryptedStates) SaveState(ctx context.Context, key string, state []byte) error {
+	nonce := make([]byte, e.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+
+	return e.states.SaveState(ctx, key, e.aead.Seal(nonce, nonce, state, e.additionalData(key)))
+}
+
+// pageState is where a page's storage state is loaded from and saved to.
+type pageState struct {
+	states BrowserStates
+	key    string
+}
+
+// load returns the saved state for the browser context options, or nil when
+// there is none yet.
+func (s pageState) load(ctx context.Context) (*playwright.OptionalStorageState, error) {
+	if s.states == nil {
+		return nil, nil
+	}
+
+	b, err := s.states.LoadState(ctx, s.key)
+	if err != nil || b == nil {
+		return nil, err
+	}
+
+	var state playwright.OptionalStorageState
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		return nil, fmt.Errorf("could not read browser state %s: %v", s.key, err)
+	}
+
+	return &state, nil
+}
+
+// saveState stores the page's cookies and localStorage, so the next browser()
+// with the same state starts logged in.
+func (s pageState) saveState(ctx context.Context, page playwright.Page, _ []any) (v interface{}, err error) {
+	if s.states == nil {
+		return nil, fmt.Errorf("browser states are not configured")
+	}
+
+	state, err := page.Context().StorageState()
+	if err != nil {
+		return nil, fmt.Errorf("could not export browser state: %v", err)
+	}
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+
+	return nil, s.states.SaveState(ctx, s.key, b)
+}
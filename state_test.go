@@ -0,0 +1,86 @@
+package bus_tracker
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// memoryStates keeps states of every function in one map, keyed by the
+// function and the state key.
+type memoryStates struct {
+	function string
+	states   map[string][]byte
+}
+
+func (m memoryStates) LoadState(_ context.Context, key string) ([]byte, error) {
+	return m.states[m.function+"/"+key], nil
+}
+
+func (m memoryStates) SaveState(_ context.Context, key string, state []byte) error {
+	m.states[m.function+"/"+key] = state
+	return nil
+}
+
+func TestEncryptedStates(t *testing.T) {
+	ctx := context.Background()
+	key := bytes.Repeat([]byte{1}, 32)
+	state := []byte(`{"cookies":[{"name":"session","value":"secret"}]}`)
+
+	tests := []struct {
+		name string
+		// change runs on the stored states after "a" saved state under
+		// "default".
+		change  func(stored map[string][]byte)
+		load    string
+		key     string
+		want    []byte
+		wantErr bool
+	}{
+		{"round trip", func(map[string][]byte) {}, "a", "default", state, false},
+		{"missing", func(map[string][]byte) {}, "a", "other", nil, false},
+		{"tampered", func(stored map[string][]byte) {
+			stored["a/default"][len(stored["a/default"])-1] ^= 1
+		}, "a", "default", nil, true},
+		{"truncated", func(stored map[string][]byte) {
+			stored["a/default"] = stored["a/default"][:4]
+		}, "a", "default", nil, true},
+		{"swapped key", func(stored map[string][]byte) {
+			stored["a/other"] = stored["a/default"]
+		}, "a", "other", nil, true},
+		{"swapped function", func(stored map[string][]byte) {
+			stored["b/default"] = stored["a/default"]
+		}, "b", "default", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored := map[string][]byte{}
+			encrypt := func(function string) BrowserStates {
+				states, err := NewEncryptedStates(memoryStates{function: function, states: stored}, function, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return states
+			}
+
+			err := encrypt("a").SaveState(ctx, "default", state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(stored["a/default"], []byte("secret")) {
+				t.Fatal("state is stored in the clear")
+			}
+
+			tt.change(stored)
+
+			got, err := encrypt(tt.load).LoadState(ctx, tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadState() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("LoadState() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var _ Storage = (*Local)(nil)
+
+// Local stores files in a directory, for development and tests. Files are
+// expected to be served from baseUrl by something else, e.g. a static file
+// server.
+type Local struct {
+	dir     string
+	baseUrl string
+}
+
+func NewLocal(dir string, baseUrl string) (*Local, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("local storage needs a directory")
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	if baseUrl == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		baseUrl = (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String()
+	}
+
+	return &Local{
+		dir:     dir,
+		baseUrl: strings.TrimSuffix(baseUrl, "/"),
+	}, nil
+}
+
+func (l *Local) path(key string) (string, error) {
+	path := filepath.Join(l.dir, filepath.FromSlash(key))
+	if !strings.HasPrefix(path, filepath.Clean(l.dir)+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid key %s", key)
+	}
+
+	return path, nil
+}
+
+// Put writes body to its file. Content type and metadata go to a
+// <key>.meta.json file next to it.
+func (l *Local) Put(_ context.Context, key string, body io.Reader, options PutOptions) (err error) {
+	path, err := l.path(key)
+	if err != nil {
+		return
+	}
+
+	err = writeFile(path, body)
+	if err != nil {
+		return
+	}
+
+	meta, err := json.Marshal(options)
+	if err != nil {
+		return
+	}
+
+	return writeFile(path+".meta.json", bytes.NewReader(meta))
+}
+
+func (l *Local) Get(_ context.Context, key string) ([]byte, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(path)
+}
+
+func (l *Local) Exists(_ context.Context, key string) (bool, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// writeFile writes to a temporary file first so readers never see a partial
+// file.
+func writeFile(path string, body io.Reader) (err error) {
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, body)
+	if err != nil {
+		_ = f.Close()
+		return
+	}
+
+	err = f.Close()
+	if err != nil {
+		return
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+func (l *Local) PublicURL(key string) string {
+	return l.baseUrl + "/" + key
+}
+
+// SignedURL returns the public URL, as a local directory has no access
+// control to sign for.
+func (l *Local) SignedURL(_ context.Context, key string, _ time.Duration) (string, error) {
+	return l.PublicURL(key), nil
+}
+
+func (l *Local) Delete(_ context.Context, key string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	_ = os.Remove(path + ".meta.json")
+
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
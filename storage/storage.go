@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Storage keeps the files scripts produce, such as images, under a key.
+type Storage interface {
+	// Put stores body under key, replacing anything stored there.
+	Put(ctx context.Context, key string, body io.Reader, options PutOptions) error
+	// Get reads what is stored under key.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Exists reports whether something is stored under key.
+	Exists(ctx context.Context, key string) (bool, error)
+	// PublicURL returns the URL key can be downloaded from without credentials.
+	PublicURL(key string) string
+	// SignedURL returns a URL that grants access to key until expiresIn passes.
+	SignedURL(ctx context.Context, key string, expiresIn time.Duration) (string, error)
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+type PutOptions struct {
+	ContentType string
+	// Metadata is kept along with the file, e.g. its original filename.
+	Metadata map[string]string
+}
+
+// FromEnv builds the Storage selected by STORAGE_BACKEND, one of supabase,
+// local or s3. Without STORAGE_BACKEND, supabase is used.
+func FromEnv() (Storage, error) {
+	bucket := os.Getenv("STORAGE_BUCKET")
+	if bucket == "" {
+		bucket = "images"
+	}
+
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "supabase":
+		return NewSupabase(os.Getenv("SUPABASE_STORAGE_BASE_URL"), os.Getenv("SUPABASE_SERVICE_KEY"), bucket), nil
+	case "local":
+		return NewLocal(os.Getenv("STORAGE_LOCAL_DIR"), os.Getenv("STORAGE_LOCAL_BASE_URL"))
+	case "s3":
+		return NewS3(S3Options{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          bucket,
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			PublicBaseURL:   os.Getenv("S3_PUBLIC_BASE_URL"),
+		})
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %s", backend)
+	}
+}
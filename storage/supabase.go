@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	storage_go "github.com/supabase-community/storage-go"
+)
+
+var _ Storage = (*Supabase)(nil)
+
+// Supabase stores files in a Supabase storage bucket.
+type Supabase struct {
+	client     *storage_go.Client
+	baseUrl    string
+	serviceKey string
+	bucket     string
+	http       *http.Client
+}
+
+func NewSupabase(baseUrl string, serviceKey string, bucket string) *Supabase {
+	return &Supabase{
+		client:     storage_go.NewClient(baseUrl, serviceKey, nil),
+		baseUrl:    strings.TrimSuffix(baseUrl, "/"),
+		serviceKey: serviceKey,
+		bucket:     bucket,
+		http:       &http.Client{Timeout: time.Minute},
+	}
+}
+
+// objectRequest builds an authenticated request for key. Uploads don't go
+// through storage_go, as it keeps per-upload headers on the shared client and
+// can't send metadata.
+func (s *Supabase) objectRequest(ctx context.Context, method string, key string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.baseUrl+"/object/"+s.bucket+"/"+key, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+s.serviceKey)
+	return req, nil
+}
+
+func (s *Supabase) Put(ctx context.Context, key string, body io.Reader, options PutOptions) (err error) {
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return
+	}
+
+	req, err := s.objectRequest(ctx, http.MethodPost, key, bytes.NewReader(b))
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("x-upsert", "true")
+	if options.ContentType != "" {
+		req.Header.Set("Content-Type", options.ContentType)
+	}
+
+	if len(options.Metadata) > 0 {
+		metadata, err := json.Marshal(options.Metadata)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("x-metadata", base64.StdEncoding.EncodeToString(metadata))
+	}
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("supabase upload %s: %s %s", key, resp.Status, b)
+	}
+
+	return nil
+}
+
+func (s *Supabase) Get(ctx context.Context, key string) (b []byte, err error) {
+	req, err := s.objectRequest(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("supabase download %s: %s", key, resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+func (s *Supabase) Exists(ctx context.Context, key string) (bool, error) {
+	req, err := s.objectRequest(ctx, http.MethodHead, key, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return true, nil
+	// storage-api answers 400 instead of 404 for missing objects on some
+	// versions.
+	case resp.StatusCode == http.StatusNotFound, resp.StatusCode == http.StatusBadRequest:
+		return false, nil
+	default:
+		return false, fmt.Errorf("supabase head %s: %s", key, resp.Status)
+	}
+}
+
+func (s *Supabase) PublicURL(key string) string {
+	return s.client.GetPublicUrl(s.bucket, key).SignedURL
+}
+
+func (s *Supabase) SignedURL(_ context.Context, key string, expiresIn time.Duration) (string, error) {
+	resp, err := s.client.CreateSignedUrl(s.bucket, key, int(expiresIn.Seconds()))
+	if err != nil {
+		return "", err
+	}
+
+	return resp.SignedURL, nil
+}
+
+func (s *Supabase) Delete(_ context.Context, key string) error {
+	_, err := s.client.RemoveFile(s.bucket, []string{key})
+	return err
+}
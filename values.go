@@ -0,0 +1,62 @@
+package bus_tracker
+
+import (
+	"fmt"
+	lox "github.com/ariyn/lox_interpreter"
+	"math/big"
+	"net/url"
+	"time"
+)
+
+// maxValueDepth stops toLoxValue on values that refer to themselves, which
+// page.evaluate() can return.
+const maxValueDepth = 64
+
+// toLoxValue converts a value decoded from JSON or returned by page JavaScript
+// into Lox values: numbers become float64, arrays ListType and objects
+// DictType.
+func toLoxValue(v interface{}) (interface{}, error) {
+	return toLoxValueDepth(v, 0)
+}
+
+func toLoxValueDepth(v interface{}, depth int) (interface{}, error) {
+	if depth > maxValueDepth {
+		return nil, fmt.Errorf("value is nested deeper than %d levels", maxValueDepth)
+	}
+
+	switch v := v.(type) {
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(v).Float64()
+		return f, nil
+	case *url.URL:
+		return v.String(), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case []interface{}:
+		list := make(lox.ListType, len(v))
+		for i, item := range v {
+			converted, err := toLoxValueDepth(item, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = converted
+		}
+		return list, nil
+	case map[string]interface{}:
+		dict := make(lox.DictType, len(v))
+		for k, item := range v {
+			converted, err := toLoxValueDepth(item, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			dict[k] = converted
+		}
+		return dict, nil
+	}
+
+	return v, nil
+}